@@ -3,386 +3,6483 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
 )
 
 // Configuration and constant definitions
 const (
-	githubAPIURL = "https://api.github.com/repos/zen-browser/desktop/releases/latest"
-	coprProject  = "51ddh4r7h/zen-browser"
+	githubAPIURL      = "https://api.github.com/repos/zen-browser/desktop/releases/latest"
+	githubReleasesURL = "https://api.github.com/repos/zen-browser/desktop/releases?per_page=100"
+	githubTagURL      = "https://api.github.com/repos/zen-browser/desktop/releases/tags/"
+	githubMaxPages    = 5
+	coprAPIURL        = "https://copr.fedorainfracloud.org/api_3"
+	coprProject       = "51ddh4r7h/zen-browser"
+	archiveRepo       = "51ddh4r7h/ZenBrowser"
+	packageName       = "zen-browser"
 )
 
-// ReleaseInfo stores the release information from GitHub
+// Version of this tool, set when building with
+// -ldflags "-X main.toolVersion=v1.2.3"
+var toolVersion = "dev"
+
+// HTTP client used for all GitHub API and download requests
+var httpClient = &http.Client{}
+
+// CommandRunner runs an external command and returns its stdout and stderr
+type CommandRunner func(name string, args ...string) (string, string, error)
+
+// Runner used for rpmbuild, copr-cli and git, replaceable in tests
+var runCommand CommandRunner = execCommand
+
+// ExecCommand runs a command on the host
+func execCommand(name string, args ...string) (string, string, error) {
+	cmd := exec.Command(name, args...)
+	traceCommand(cmd)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// TraceCommands logs every external command before it runs, set with
+// --trace-commands
+var traceCommands bool
+
+// TraceCommand logs a command's argument vector, quoted for a shell, and
+// its working directory when traceCommands is set. Secrets are redacted by
+// the logger.
+func traceCommand(cmd *exec.Cmd) {
+	if !traceCommands {
+		return
+	}
+	dir := cmd.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	quoted := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		quoted[i] = shellQuote(arg)
+	}
+	out.Printf("trace: (in %s) %s\n", dir, strings.Join(quoted, " "))
+}
+
+// ShellSafeRegex matches arguments a shell takes literally without quotes
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_./:=,+@%-]+$`)
+
+// ShellQuote quotes an argument for a POSIX shell unless it needs no quoting
+func shellQuote(arg string) string {
+	if shellSafeRegex.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// Sleep waits out rate limits, replaceable in tests
+var sleep = time.Sleep
+
+// Asset names that may hold the SHA-256 of the tarballs, besides a
+// "<tarball>.sha256" file next to each one
+var checksumManifestNames = []string{"sha256sums.txt", "SHA256SUMS", "checksums.txt"}
+
+// Architectures Zen Browser publishes Linux tarballs for
+var supportedArches = []string{"x86_64", "aarch64"}
+
+// ReleaseInfo stores the release information from GitHub. Version is the
+// RPM version derived from the upstream Tag.
 type ReleaseInfo struct {
+	Arch        string
 	Version     string
+	Tag         string
 	DownloadURL string
+	// Filename is the tarball's name in SOURCES, from --filename-from, and
+	// AssetName its name in the release
 	Filename    string
+	AssetName   string
 	PublishedAt string
+	// ChecksumURL is the release's checksum manifest for the tarball, if
+	// any, and SHA256 the expected checksum, from the asset's digest or
+	// once the manifest has been fetched
+	ChecksumURL string
+	SHA256      string
+	// Notes is the release's description on GitHub
+	Notes string
+	// Fallback marks an older release chosen by --skip-to-previous because
+	// the latest one was skipped
+	Fallback bool
+	// Size is the asset's size listed in the release, 0 if unknown.
+	// ContentLength is the size its HEAD request reported, -1 if unknown,
+	// once Checked says the request was sent.
+	Size          int64
+	ContentLength int64
+	Checked       bool
 }
 
 // GitHubRelease represents the GitHub release API response structure
 type GitHubRelease struct {
 	TagName     string  `json:"tag_name"`
 	PublishedAt string  `json:"published_at"`
+	Body        string  `json:"body"`
+	Draft       bool    `json:"draft"`
+	Prerelease  bool    `json:"prerelease"`
 	Assets      []Asset `json:"assets"`
 }
 
+// RejectedRelease records why release selection passed over a release
+type RejectedRelease struct {
+	Tag    string
+	Reason string
+	// Kind is ErrTwilightSkipped, errVersionSkipped, ErrNotReady or
+	// ErrNoAsset, telling getLatestRelease how to treat a rejected latest
+	// release, and nil for drafts and prereleases
+	Kind error
+}
+
 // Asset represents a release asset from GitHub
 type Asset struct {
 	Name        string `json:"name"`
 	DownloadURL string `json:"browser_download_url"`
+	Size        int64  `json:"size"`
+	// Digest is set by newer API versions, e.g. "sha256:<hex>"
+	Digest string `json:"digest"`
 }
 
-// Get the RPM build path, supporting different environments
-func getRpmbuildPath() string {
-	// First check if RPM_BUILD_ROOT environment variable is set
-	if rpmBuildRoot, exists := os.LookupEnv("RPM_BUILD_ROOT"); exists {
-		return rpmBuildRoot
+// Subcommands accepted as the first argument; without one the update runs
+var commands = []string{"doctor", "status", "assets", "list-assets"}
+
+// Options holds the command line configuration
+type Options struct {
+	Command string
+
+	QuietUpToDate       bool
+	SummaryFile         string
+	SummaryStdout       bool
+	Arch                string
+	CheckDownload       bool
+	StateFile           string
+	GitCommit           bool
+	AllowDirty          bool
+	DetectRespin        bool
+	Downloader          string
+	ArchiveSRPM         bool
+	ArchiveRepo         string
+	OutputDir           string
+	HistoryDB           string
+	CoprPruneKeep       int
+	MinAssets           int
+	RequireAssets       string
+	SkipVersions        string
+	SkipToPrevious      bool
+	ChangelogTemplate   string
+	ChangelogName       string
+	ChangelogEmail      string
+	CoprProject         string
+	StagingProject      string
+	CompareCoprChecksum bool
+	Wait                bool
+	Chroots             string
+	CoprBuildOpts       []string
+	CoprBackground      bool
+	FetchFailureLogs    bool
+	NoSubmit            bool
+	MinFreeSpace        int64
+	RedactSecrets       bool
+	SaveBuildLogs       bool
+	SourceFile          string
+	SourceURL           string
+	SourceVersion       string
+	SourceSHA256        string
+	AssumeVersion       string
+	MaxChangelogEntries int
+	SetFields           stringList
+	ShipChangelog       bool
+	Debug               bool
+	Explain             bool
+	TraceCommands       bool
+	LogFile             string
+	NoColor             bool
+	Color               string
+	ChangelogAll        bool
+	OutputFormat        string
+	SRPMChecksum        bool
+	SRPMSHA512          bool
+	FreezeUntil         time.Time
+	RateLimitWait       time.Duration
+	RpmlintIgnore       stringList
+	ValidateReachable   bool
+	ChangelogMessage    string
+	ChecksumPolicy      string
+	ChecksumRetries     int
+	RpmbuildRetries     int
+	TransientPatterns   []*regexp.Regexp
+	ReportDownloadSpeed bool
+	GitHubTokenFile     string
+	GitHubToken         string
+	CoprTokenFile       string
+	GitHubAppID         string
+	GitHubAppKeyFile    string
+	InstallationID      string
+	Report              string
+	ReportFile          string
+	AlignSourceName     string
+	PostSuccessHook     string
+	PreSubmitHook       string
+	VersionTransforms   []string
+	Timezone            *time.Location
+	SummaryAppend       bool
+	FilenameFrom        string
+	SizeThreshold       float64
+	SizeStrict          bool
+	ChangelogFooter     bool
+	Prefetch            bool
+	Concurrency         int
+	VerifyInternal      bool
+	VerifyExtract       bool
+	ArtifactUpload      string
+	S3Endpoint          string
+	VersionPrefix       string
+	Output              string
+	TempSpec            bool
+	Tag                 string
+	SinceTag            string
+	CoprPreflight       bool
+	RecordHTTP          string
+	PreferIPv4          bool
+	ReplayHTTP          string
+	Rpmlint             bool
+	RpmlintRequire      bool
+	RpmlintFailOn       string
+	Interval            time.Duration
+	MaxCycles           int
+	IntervalJitter      float64
+	NoLock              bool
+	KeepTemp            bool
+}
+
+// ParseFlags parses the command line arguments into Options
+func parseFlags(args []string) (*Options, error) {
+	opts := &Options{}
+	fs := flag.NewFlagSet("update-zen-browser", flag.ContinueOnError)
+	fs.BoolVar(&opts.QuietUpToDate, "quiet-up-to-date", false, "print nothing when already at the latest version")
+	fs.BoolVar(&opts.Debug, "debug", false, "print debugging details such as raw API responses")
+	fs.BoolVar(&opts.Explain, "explain", false, "narrate why each release, version and asset was or was not acted on")
+	fs.BoolVar(&opts.TraceCommands, "trace-commands", false, "log every external command with its arguments and working directory before running it")
+	fs.StringVar(&opts.LogFile, "log-file", "", "also append every progress message to this file, without color codes")
+	fs.BoolVar(&opts.NoColor, "no-color", false, "never print color codes, like --color never")
+	fs.StringVar(&opts.Color, "color", "auto", "color messages: auto (when stdout is a terminal), always or never")
+	fs.StringVar(&opts.SummaryFile, "summary-file", "", "write the JSON run summary to this file")
+	fs.BoolVar(&opts.SummaryAppend, "summary-append", false, "add this run's summary to --summary-file, keeping a JSON array of runs, instead of replacing it")
+	fs.BoolVar(&opts.SummaryStdout, "summary-stdout", false, "print the JSON run summary to stdout after the logs")
+	fs.StringVar(&opts.Output, "output", "text", "output of the status subcommand: text or json")
+	fs.StringVar(&opts.OutputFormat, "output-format", "json", "format of the run summary: json or markdown")
+	fs.StringVar(&opts.Report, "report", "", "print a report of the run for a pull request or issue description: markdown")
+	fs.StringVar(&opts.ReportFile, "report-file", "", "write the --report to this file instead of stdout")
+	fs.StringVar(&opts.Arch, "arch", "x86_64", "architecture to build: x86_64, aarch64 or all")
+	fs.BoolVar(&opts.Prefetch, "prefetch", false, "only download and verify the latest release's tarballs into SOURCES, even if the spec is current")
+	fs.BoolVar(&opts.ReportDownloadSpeed, "report-download-speed", false, "log each tarball's download time and average speed, and add them to the summary")
+	fs.BoolVar(&opts.CheckDownload, "check-download", false, "only confirm the release assets are reachable and report their size")
+	fs.StringVar(&opts.StateFile, "state-file", "", "file caching state between runs (default <rpmbuild>/zen-browser-state.json)")
+	fs.BoolVar(&opts.TempSpec, "temp-spec", false, "edit and build a temporary copy of the spec, replacing the real one only once the SRPM is submitted")
+	fs.BoolVar(&opts.GitCommit, "git-commit", false, "commit the version bump in the git repository holding the spec")
+	fs.BoolVar(&opts.AllowDirty, "allow-dirty", false, "with --git-commit, proceed even if the work tree has other changes")
+	fs.BoolVar(&opts.DetectRespin, "detect-respin", false, "when the version is unchanged, rebuild with a bumped Release if the tarball checksum changed")
+	fs.StringVar(&opts.ChecksumPolicy, "checksum-policy", "prefer", "tarball verification: require a published checksum, prefer (verify when published) or skip")
+	fs.IntVar(&opts.RpmbuildRetries, "rpmbuild-retries", 2, "run rpmbuild again up to this many times after a failure that looks transient (0 never retries)")
+	transientPattern := stringList{}
+	fs.Var(&transientPattern, "rpmbuild-transient-pattern", "regular expression matching rpmbuild error output of a transient failure, besides the built-in ones (repeatable)")
+	fs.IntVar(&opts.ChecksumRetries, "retry-download-checksum-mismatch", 2, "download a tarball again up to this many times when its checksum does not match (0 fails at once)")
+	fs.BoolVar(&opts.VerifyExtract, "verify-extract", false, "after downloading, extract the tarball to a temporary directory and check its structure")
+	fs.BoolVar(&opts.VerifyInternal, "verify-internal-version", false, "after downloading, check the version in the tarball's application.ini matches the release tag")
+	fs.IntVar(&opts.Concurrency, "concurrency", 2, "number of spec files processed at once; only their downloads overlap")
+	fs.Float64Var(&opts.SizeThreshold, "size-regression-threshold", 0.5, "warn when a new tarball is smaller than this fraction of the previous one (0 disables)")
+	fs.BoolVar(&opts.SizeStrict, "size-regression-strict", false, "fail instead of warning when a tarball is below --size-regression-threshold")
+	fs.StringVar(&opts.FilenameFrom, "filename-from", "name", "name of the tarball in SOURCES: the asset's name or the download URL's basename (url)")
+	fs.StringVar(&opts.AlignSourceName, "align-source-name", "", "when a Source line's file name differs from the downloaded tarball's: rename the tarball (file) or add a #/ fragment to the Source (spec)")
+	fs.StringVar(&opts.Downloader, "downloader", "http", "tool used to download tarballs: http or aria2c")
+	fs.BoolVar(&opts.ArchiveSRPM, "archive-srpm-to-github", false, "upload the submitted SRPM to a GitHub release tagged with the version (needs GITHUB_TOKEN, --github-token-file or --github-app-id)")
+	fs.StringVar(&opts.GitHubAppID, "github-app-id", "", "authenticate to the GitHub API as this GitHub App, with --github-app-key-file and --github-installation-id")
+	fs.StringVar(&opts.GitHubAppKeyFile, "github-app-key-file", "", "PEM private key of the GitHub App")
+	fs.StringVar(&opts.InstallationID, "github-installation-id", "", "installation of the GitHub App whose access token is used")
+	fs.StringVar(&opts.GitHubTokenFile, "github-token-file", "", "read the GitHub token from this file instead of GITHUB_TOKEN")
+	fs.StringVar(&opts.CoprTokenFile, "copr-token-file", "", "copr-cli configuration file holding the COPR API token (default ~/.config/copr)")
+	fs.StringVar(&opts.ArchiveRepo, "archive-repo", archiveRepo, "GitHub repository (owner/name) receiving archived SRPMs")
+	fs.StringVar(&opts.ArtifactUpload, "artifact-upload", "", "upload the SRPM and its checksum to s3://bucket/prefix (credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	fs.StringVar(&opts.S3Endpoint, "s3-endpoint", "", "S3-compatible endpoint URL for --artifact-upload (default https://s3.<AWS_REGION>.amazonaws.com)")
+	fs.StringVar(&opts.HistoryDB, "history-db", "", "record each run as a row in this SQLite database (needs the sqlite3 command)")
+	fs.StringVar(&opts.OutputDir, "output-dir", "", "collect the spec, SRPM, summary and spec diff of each run in a timestamped directory here")
+	fs.IntVar(&opts.CoprPruneKeep, "copr-prune-keep", 0, "after a successful submit, delete all but the N most recent COPR builds of the package (0 keeps all)")
+	fs.IntVar(&opts.MinAssets, "min-assets", 0, "treat a release with fewer assets as not ready yet")
+	fs.StringVar(&opts.RequireAssets, "require-assets", "", "comma-separated asset names a release must have to be considered ready")
+	fs.StringVar(&opts.VersionPrefix, "version-prefix", "v", "prefix stripped from release tags to form the RPM version")
+	fs.BoolVar(&opts.SkipToPrevious, "skip-to-previous", false, "when the latest release is in --skip-versions, build the newest earlier release that is acceptable instead")
+	fs.StringVar(&opts.SkipVersions, "skip-versions", "", "comma-separated versions known to be broken, which are never built")
+	fs.StringVar(&opts.PreSubmitHook, "pre-submit-hook", "", "command run with the SRPM path as its argument before submitting; a non-zero exit aborts the submit")
+	fs.StringVar(&opts.PostSuccessHook, "post-success-hook", "", "command run after a successful submit, with ZEN_VERSION and ZEN_BUILD_ID set; failures are only logged")
+	fs.BoolVar(&opts.NoSubmit, "no-submit", false, "update the spec and build the SRPM, but do not submit it to COPR")
+	fs.StringVar(&opts.StagingProject, "staging-copr-project", "", "with --wait, build in this COPR project first and only submit to --copr-project if that succeeds")
+	fs.BoolVar(&opts.CompareCoprChecksum, "compare-checksum-with-copr", false, "skip submitting when the last successful COPR build was made from the same tarballs")
+	fs.BoolVar(&opts.Wait, "wait", false, "wait for the COPR build to finish and fail unless it succeeds")
+	coprBuildOpts := fs.String("copr-build-opts", "", "extra copr-cli build options, e.g. \"--enable-net on --timeout 36000\" (only "+strings.Join(coprBuildOptionNames(), ", ")+")")
+	fs.BoolVar(&opts.FetchFailureLogs, "fetch-failure-logs", false, "with --wait, include the error lines of a failed COPR build's logs in the error")
+	fs.BoolVar(&opts.CoprBackground, "copr-background", false, "submit COPR builds as background jobs and return once the build is created")
+	fs.StringVar(&opts.Chroots, "chroots", "", "comma-separated COPR chroots to build for, or auto for those enabled in the project (default: the project's defaults)")
+	fs.StringVar(&opts.CoprProject, "copr-project", coprProject, "COPR project as owner/project; {channel} and {arch} are replaced for each build")
+	fs.BoolVar(&opts.ShipChangelog, "ship-changelog", false, "save the upstream release notes to SOURCES and ship them in the package as %doc")
+	fs.Var(&opts.SetFields, "set-field", "set a spec tag or %global/%define macro after updating, as Name=Value (repeatable)")
+	fs.StringVar(&opts.ChangelogMessage, "changelog-message", "", "use this text for the changelog entry instead of \"Update to X\"; each line becomes a \"- \" item")
+	fs.StringVar(&opts.ChangelogName, "changelog-name", defaultChangelogName, "author name of new changelog entries")
+	fs.StringVar(&opts.ChangelogEmail, "changelog-email", defaultChangelogEmail, "author email address of new changelog entries")
+	fs.BoolVar(&opts.ChangelogFooter, "changelog-footer", false, "end each new changelog entry with a line naming this tool's version and the host")
+	fs.BoolVar(&opts.ChangelogAll, "changelog-all-releases", false, "list every release since the spec's version in the changelog entry, not just the newest")
+	fs.StringVar(&opts.SinceTag, "since-tag", "", "with --changelog-all-releases, list the releases after this tag instead of after the spec's version")
+	fs.IntVar(&opts.MaxChangelogEntries, "max-changelog-entries", 0, "keep only this many of the newest changelog entries in the spec (0 keeps all)")
+	fs.StringVar(&opts.ChangelogTemplate, "changelog-template", "", "file with a text/template for changelog entries, using {{.Date}}, {{.Author}}, {{.Version}} and {{.Body}}")
+	fs.BoolVar(&opts.ValidateReachable, "validate-url-reachable", false, "before doing any work, check the COPR frontend answers, failing fast during an outage")
+	fs.BoolVar(&opts.CoprPreflight, "copr-preflight", false, "check the COPR project exists and we are authenticated before building")
+	fs.BoolVar(&opts.PreferIPv4, "prefer-ipv4", false, "connect over IPv4 when possible, for networks with broken IPv6 routes")
+	fs.StringVar(&opts.RecordHTTP, "record-http", "", "save every HTTP request and response to this directory")
+	fs.StringVar(&opts.ReplayHTTP, "replay-http", "", "serve HTTP responses from recordings in this directory instead of the network")
+	fs.BoolVar(&opts.Rpmlint, "rpmlint", false, "run rpmlint on the SRPM before submitting, skipped if rpmlint is not installed")
+	fs.BoolVar(&opts.RpmlintRequire, "rpmlint-require", false, "with --rpmlint, fail if rpmlint is not installed")
+	fs.StringVar(&opts.RpmlintFailOn, "rpmlint-fail-on", "error", "rpmlint findings that fail the run: error, warning or none")
+	fs.DurationVar(&opts.RateLimitWait, "rate-limit-wait", 2*time.Minute, "longest GitHub secondary rate limit Retry-After to wait out before retrying (0 never waits)")
+	fs.Var(&opts.RpmlintIgnore, "rpmlint-ignore", "rpmlint diagnostic code that never fails the run (repeatable)")
+	fs.DurationVar(&opts.Interval, "interval", 0, "keep running and check again at this interval (e.g. 30m)")
+	fs.Float64Var(&opts.IntervalJitter, "interval-jitter", 0, "with --interval, vary each wait randomly by up to this percentage (0-100)")
+	fs.IntVar(&opts.MaxCycles, "max-cycles", 0, "with --interval, stop after this many checks (0 runs until terminated)")
+	fs.BoolVar(&opts.KeepTemp, "keep-temp", false, "keep the run's temporary files when it fails, for inspection")
+	fs.BoolVar(&opts.NoLock, "no-lock", false, "do not take the lock that prevents concurrent runs")
+	fs.StringVar(&opts.AssumeVersion, "assume-version", "", "treat this as the current version instead of reading the spec, e.g. 0 to bootstrap a placeholder spec")
+	fs.StringVar(&opts.SourceFile, "source-file", "", "use this local tarball as the source instead of downloading the release's")
+	fs.StringVar(&opts.SourceURL, "source-url", "", "build the tarball at this URL instead of a GitHub release (needs --source-version)")
+	fs.StringVar(&opts.SourceVersion, "source-version", "", "with --source-url, the version to package the tarball as")
+	fs.StringVar(&opts.SourceSHA256, "source-sha256", "", "with --source-url, the SHA-256 the tarball must have")
+	fs.BoolVar(&opts.SRPMChecksum, "srpm-checksum", false, "print the SHA-256 of the SRPM and write it to a .sha256 file next to it (on by default with a JSON summary)")
+	fs.BoolVar(&opts.SRPMSHA512, "srpm-sha512", false, "with --srpm-checksum, also compute the SHA-512 and write a .sha512 file")
+	fs.BoolVar(&opts.SaveBuildLogs, "save-build-logs", false, "keep the rpmbuild output in a log file even when the build succeeds")
+	fs.BoolVar(&opts.RedactSecrets, "redact-secrets", true, "mask tokens, passwords and signed URL parameters in logs and errors")
+	freezeUntil := fs.String("freeze-until", "", "report new versions but do not build them before this date (YYYY-MM-DD or RFC 3339)")
+	versionTransform := fs.String("version-transform", "", "comma-separated rules turning the tag into the RPM version: replace-dash-with-tilde, replace-dash-with-underscore, strip-suffix, lowercase")
+	timezone := fs.String("timezone", "UTC", "IANA time zone, such as Europe/Berlin, in which changelog entries are dated")
+	minFreeSpace := fs.String("min-free-space", "2GB", "free space needed in the rpmbuild tree before downloading, besides the tarballs (0 disables)")
+
+	for _, command := range commands {
+		if len(args) > 0 && args[0] == command {
+			opts.Command = command
+			args = args[1:]
+		}
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Command == "assets" {
+		if fs.NArg() != 1 {
+			err := fmt.Errorf("usage: update-zen-browser assets [options] <tag>")
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		opts.Tag = fs.Arg(0)
+	}
+	if opts.Command == "list-assets" {
+		if fs.NArg() > 1 {
+			err := fmt.Errorf("usage: update-zen-browser list-assets [options] [tag]")
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		opts.Tag = fs.Arg(0)
+	}
+	if _, err := archList(opts.Arch); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	for _, field := range opts.SetFields {
+		if name, _, ok := strings.Cut(field, "="); !ok || strings.TrimSpace(name) == "" {
+			err := fmt.Errorf("invalid --set-field value %q: expected Name=Value", field)
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	if opts.NoColor {
+		opts.Color = "never"
+	}
+	if (opts.GitHubAppID != "" || opts.GitHubAppKeyFile != "" || opts.InstallationID != "") &&
+		(opts.GitHubAppID == "" || opts.GitHubAppKeyFile == "" || opts.InstallationID == "") {
+		err := fmt.Errorf("--github-app-id, --github-app-key-file and --github-installation-id must be given together")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.Color != "auto" && opts.Color != "always" && opts.Color != "never" {
+		err := fmt.Errorf("invalid --color value %q: expected auto, always or never", opts.Color)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.StagingProject != "" && !opts.Wait {
+		err := fmt.Errorf("--staging-copr-project needs --wait")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.IntervalJitter < 0 || opts.IntervalJitter > 100 {
+		err := fmt.Errorf("invalid --interval-jitter value %v: expected a percentage from 0 to 100", opts.IntervalJitter)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.SourceFile != "" && opts.Arch == "all" {
+		err := fmt.Errorf("--source-file needs a single --arch")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if err := checkChangelogAuthor(opts.ChangelogName, opts.ChangelogEmail); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if err := checkSourceURL(opts); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.CoprBuildOpts, err = parseCoprBuildOpts(*coprBuildOpts); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if *freezeUntil != "" {
+		if opts.FreezeUntil, err = parseFreezeDate(*freezeUntil); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	for _, pattern := range transientPattern {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			err = fmt.Errorf("invalid --rpmbuild-transient-pattern %q: %v", pattern, err)
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		opts.TransientPatterns = append(opts.TransientPatterns, compiled)
+	}
+	if opts.VersionTransforms, err = parseVersionTransforms(*versionTransform); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.Timezone, err = time.LoadLocation(*timezone); err != nil {
+		err = fmt.Errorf("invalid --timezone value: %v", err)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.MinFreeSpace, err = parseSize(*minFreeSpace); err != nil {
+		err = fmt.Errorf("invalid --min-free-space value: %v", err)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.ArtifactUpload != "" {
+		if _, _, err := parseS3URL(opts.ArtifactUpload); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	switch opts.AlignSourceName {
+	case "", "file", "spec":
+	default:
+		err := fmt.Errorf("invalid --align-source-name value: %s", opts.AlignSourceName)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.ReportFile != "" && opts.Report == "" {
+		opts.Report = "markdown"
+	}
+	if opts.Report != "" && opts.Report != "markdown" {
+		err := fmt.Errorf("invalid --report value: %s", opts.Report)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.FilenameFrom != "name" && opts.FilenameFrom != "url" {
+		err := fmt.Errorf("invalid --filename-from value: %s", opts.FilenameFrom)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	switch opts.ChecksumPolicy {
+	case "require", "prefer", "skip":
+	default:
+		err := fmt.Errorf("invalid --checksum-policy value: %s", opts.ChecksumPolicy)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.Output != "text" && opts.Output != "json" {
+		err := fmt.Errorf("invalid --output value: %s", opts.Output)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if opts.OutputFormat != "json" && opts.OutputFormat != "markdown" {
+		err := fmt.Errorf("invalid --output-format value: %s", opts.OutputFormat)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	switch opts.RpmlintFailOn {
+	case "error", "warning", "none":
+	default:
+		err := fmt.Errorf("invalid --rpmlint-fail-on value: %s", opts.RpmlintFailOn)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	// Checked once here rather than warning on every run. Recording history
+	// is best effort, so a missing sqlite3 only turns it off.
+	if opts.HistoryDB != "" {
+		if _, err := exec.LookPath("sqlite3"); err != nil {
+			fmt.Fprintf(fs.Output(), "Warning: --history-db needs the sqlite3 command, runs will not be recorded: %v\n", err)
+			opts.HistoryDB = ""
+		}
+	}
+	return opts, nil
+}
+
+// ParseFreezeDate parses a --freeze-until value, either a local date, which
+// freezes until the start of that day, or an RFC 3339 time
+func parseFreezeDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --freeze-until value %q: expected YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// StringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// ParseSize parses a byte count such as "500MB", "2G" or "1GiB". Units are
+// powers of 1024 and a plain number is in bytes.
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSpace(value)
+	number = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(number), "B"), "I")
+	var shift uint
+	if number != "" {
+		if i := strings.IndexByte("KMGT", number[len(number)-1]); i >= 0 {
+			shift = 10 * uint(i+1)
+			number = number[:len(number)-1]
+		}
+	}
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("not a size: %q", value)
+	}
+	return int64(size * float64(int64(1)<<shift)), nil
+}
+
+// ArchList expands the --arch value into the architectures to build
+func archList(arch string) ([]string, error) {
+	if arch == "all" {
+		return supportedArches, nil
+	}
+	for _, supported := range supportedArches {
+		if arch == supported {
+			return []string{arch}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported architecture: %s", arch)
+}
+
+// CoprProjectRegex matches COPR's owner/project names; group projects are
+// owned by "@group"
+var coprProjectRegex = regexp.MustCompile(`^@?[A-Za-z0-9_.-]+/[A-Za-z0-9_.+-]+$`)
+
+// ResolveCoprProject fills {channel} and {arch} into a COPR project template
+// and checks the result is a valid owner/project name
+func resolveCoprProject(template, channel, arch string) (string, error) {
+	project := strings.NewReplacer("{channel}", channel, "{arch}", arch).Replace(template)
+	if !coprProjectRegex.MatchString(project) {
+		return "", fmt.Errorf("invalid COPR project %q: expected owner/project", project)
+	}
+	return project, nil
+}
+
+// ReleaseChannel names the release channel a version belongs to
+func releaseChannel(version string) string {
+	if strings.Contains(version, "t") {
+		return "twilight"
+	}
+	return "stable"
+}
+
+// State is cached between runs in the state file
+type State struct {
+	// Validators from the last successful latest release API response
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Latest stable release seen, reported again when the API returns 304
+	LatestVersion string `json:"latest_version,omitempty"`
+	PublishedAt   string `json:"published_at,omitempty"`
+
+	// Checksum of the last tarball used for each arch
+	Checksums map[string]SourceChecksum `json:"checksums,omitempty"`
+
+	// Last build submitted to each COPR project
+	CoprBuilds map[string]CoprBuildRecord `json:"copr_builds,omitempty"`
+}
+
+// SourceChecksum records the SHA-256 and size of a downloaded tarball
+type SourceChecksum struct {
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size,omitempty"`
+}
+
+// LoadState reads the state file, returning an empty state if it is missing
+func loadState(path string) (*State, error) {
+	state := &State{}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %v", err)
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("error parsing state file: %v", err)
+	}
+	return state, nil
+}
+
+// SaveState writes the state file
+func saveState(path string, state *State) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state: %v", err)
+	}
+	if err := os.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	return nil
+}
+
+// RunSummary is the machine readable result of a run
+type RunSummary struct {
+	Arch           string `json:"arch,omitempty"`
+	Updated        bool   `json:"updated"`
+	CurrentVersion string `json:"current_version,omitempty"`
+	LatestVersion  string `json:"latest_version,omitempty"`
+	PublishedAt    string `json:"published_at,omitempty"`
+	SRPMPath       string `json:"srpm_path,omitempty"`
+	BuildID        string `json:"build_id,omitempty"`
+	StagingBuildID string `json:"staging_build_id,omitempty"`
+	Respin         bool   `json:"respin,omitempty"`
+	SpecFile       string `json:"spec_file,omitempty"`
+	BuildLog       string `json:"build_log,omitempty"`
+	BuildURL       string `json:"build_url,omitempty"`
+	SRPMSHA256     string `json:"srpm_sha256,omitempty"`
+	SRPMSHA512     string `json:"srpm_sha512,omitempty"`
+	Error          string `json:"error,omitempty"`
+
+	// SHA-256 of the source tarball of each arch
+	SourceSHA256 map[string]string `json:"source_sha256,omitempty"`
+
+	// Download size, time and speed of each arch, with --report-download-speed
+	Downloads map[string]DownloadStats `json:"downloads,omitempty"`
+
+	// Time spent in each phase of the run, in order
+	Phases     []PhaseTiming `json:"phases,omitempty"`
+	phaseStart time.Time
+
+	// Unified diff of the spec changes, collected with --output-dir
+	SpecDiff string `json:"-"`
+
+	// Upstream release notes, shown by --report
+	ReleaseNotes string `json:"-"`
+}
+
+// PhaseTiming is the time a phase of the run took
+type PhaseTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// BeginPhase ends the current phase, if any, and starts timing a new one
+func (s *RunSummary) beginPhase(name string) {
+	s.endPhase()
+	s.Phases = append(s.Phases, PhaseTiming{Name: name})
+	s.phaseStart = time.Now()
+}
+
+// RecordSourceChecksum notes the SHA-256 of an arch's source tarball
+func (s *RunSummary) recordSourceChecksum(arch, checksum string) {
+	if s.SourceSHA256 == nil {
+		s.SourceSHA256 = make(map[string]string)
+	}
+	s.SourceSHA256[arch] = checksum
+}
+
+// RecordDownload notes how an arch's tarball downloaded, unless it was
+// reused from SOURCES
+func (s *RunSummary) recordDownload(arch string, stats DownloadStats) {
+	if stats.Bytes == 0 {
+		return
+	}
+	if s.Downloads == nil {
+		s.Downloads = make(map[string]DownloadStats)
+	}
+	s.Downloads[arch] = stats
+}
+
+// EndPhase records the duration of the current phase
+func (s *RunSummary) endPhase() {
+	if s.phaseStart.IsZero() {
+		return
+	}
+	s.Phases[len(s.Phases)-1].Seconds = time.Since(s.phaseStart).Round(time.Millisecond).Seconds()
+	s.phaseStart = time.Time{}
+}
+
+// WriteSummary writes the run summary to the destinations selected in opts
+func writeSummary(opts *Options, summary *RunSummary) error {
+	if opts.SummaryFile == "" && !opts.SummaryStdout {
+		return nil
+	}
+
+	// Errors can carry colored tool output, which has no place in a summary
+	var data []byte
+	if opts.OutputFormat == "markdown" {
+		data = []byte(stripANSI(markdownSummary(summary)))
+	} else {
+		var err error
+		data, err = json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding summary: %v", err)
+		}
+		data = append(jsonANSIRegex.ReplaceAll(data, nil), '\n')
+	}
+
+	if opts.SummaryStdout {
+		os.Stdout.Write(data)
+	}
+	if opts.SummaryFile != "" && opts.SummaryAppend {
+		return appendSummary(opts.SummaryFile, opts.OutputFormat, data)
+	}
+	if opts.SummaryFile != "" {
+		if err := os.WriteFile(opts.SummaryFile, data, 0644); err != nil {
+			return fmt.Errorf("error writing summary file: %v", err)
+		}
+	}
+	return nil
+}
+
+// AppendSummary adds a run's summary to the summary file instead of
+// replacing it. JSON summaries are kept as an array with one element per
+// run; a file holding a single summary becomes the first element. Markdown
+// reports are simply appended.
+func appendSummary(path, format string, data []byte) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading summary file: %v", err)
+	}
+
+	if format == "markdown" {
+		if len(existing) > 0 {
+			data = append(append(existing, '\n'), data...)
+		}
+	} else {
+		var runs []json.RawMessage
+		if trimmed := bytes.TrimSpace(existing); len(trimmed) > 0 {
+			if err := json.Unmarshal(trimmed, &runs); err != nil {
+				var single json.RawMessage
+				if err := json.Unmarshal(trimmed, &single); err != nil {
+					return fmt.Errorf("error parsing summary file: %v", err)
+				}
+				runs = []json.RawMessage{single}
+			}
+		}
+		runs = append(runs, json.RawMessage(data))
+		if data, err = json.MarshalIndent(runs, "", "  "); err != nil {
+			return fmt.Errorf("error encoding summary: %v", err)
+		}
+		data = append(data, '\n')
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing summary file: %v", err)
+	}
+	return nil
+}
+
+// MarkdownSummary renders the run summary as a markdown report for posting
+// in issues and pull requests. Fields a failed run never reached are left out.
+func markdownSummary(summary *RunSummary) string {
+	var b strings.Builder
+	result := "Up to date"
+	switch {
+	case summary.Error != "":
+		result = "Failed"
+	case summary.Updated && summary.Respin:
+		result = "Rebuilt"
+	case summary.Updated:
+		result = "Updated"
+	}
+
+	// Keep table cells on one line and free of column separators
+	cell := func(text string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(text, "|", "\\|"), "\n", "<br>")
+	}
+
+	fmt.Fprintf(&b, "## %s run: %s\n\n", packageName, result)
+	b.WriteString("| | |\n|---|---|\n")
+	row := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "| %s | %s |\n", name, cell(value))
+		}
+	}
+	row("Previous version", summary.CurrentVersion)
+	row("New version", summary.LatestVersion)
+	if summary.LatestVersion != "" {
+		published := summary.PublishedAt
+		if published == "" {
+			published = "unknown"
+		}
+		row("Published", published)
+	}
+	arches := make([]string, 0, len(summary.SourceSHA256))
+	for arch := range summary.SourceSHA256 {
+		arches = append(arches, arch)
+	}
+	sort.Strings(arches)
+	for _, arch := range arches {
+		row("Source SHA-256 ("+arch+")", "`"+summary.SourceSHA256[arch]+"`")
+	}
+	if summary.SRPMSHA256 != "" {
+		row("SRPM SHA-256", "`"+summary.SRPMSHA256+"`")
+	}
+	if summary.BuildURL != "" {
+		row("COPR build", fmt.Sprintf("[%s](%s)", summary.BuildID, summary.BuildURL))
+	} else {
+		row("COPR build", summary.BuildID)
+	}
+	row("Error", summary.Error)
+
+	if len(summary.Phases) > 0 {
+		b.WriteString("\n### Timings\n\n| Phase | Duration |\n|---|---|\n")
+		for _, phase := range summary.Phases {
+			fmt.Fprintf(&b, "| %s | %s |\n", phase.Name, time.Duration(phase.Seconds*float64(time.Second)).Round(time.Millisecond))
+		}
+	}
+	return b.String()
+}
+
+// WriteReport writes the --report of the run to --report-file, or to stdout
+// without one
+func writeReport(opts *Options, summary *RunSummary) error {
+	if opts.Report == "" {
+		return nil
+	}
+	report := markdownReport(summary)
+	if opts.ReportFile == "" {
+		os.Stdout.WriteString(report)
+		return nil
+	}
+	if err := os.WriteFile(opts.ReportFile, []byte(report), 0644); err != nil {
+		return fmt.Errorf("error writing report file: %v", err)
+	}
+	return nil
+}
+
+// MarkdownReport renders the run as a markdown description for a pull
+// request or issue: the version change, release date, checksums, build link
+// and the upstream release notes in a collapsible section
+func markdownReport(summary *RunSummary) string {
+	var b strings.Builder
+	switch {
+	case summary.Error != "":
+		fmt.Fprintf(&b, "## Failed to update %s to %s\n\n", packageName, summary.LatestVersion)
+	case summary.Updated && summary.Respin:
+		fmt.Fprintf(&b, "## Rebuild %s %s\n\n", packageName, summary.LatestVersion)
+	case summary.Updated:
+		fmt.Fprintf(&b, "## Update %s to %s\n\n", packageName, summary.LatestVersion)
+	default:
+		fmt.Fprintf(&b, "## %s is up to date\n\n", packageName)
+	}
+
+	released := "on an unknown date"
+	if t, ok := parsePublishedAt(summary.PublishedAt); ok {
+		released = "on " + t.Format("2006-01-02")
+	}
+	switch {
+	case summary.Updated && summary.Respin:
+		fmt.Fprintf(&b, "Rebuilds %s because upstream replaced its tarball.\n", summary.LatestVersion)
+	case summary.CurrentVersion != "" && summary.CurrentVersion != summary.LatestVersion:
+		fmt.Fprintf(&b, "Updates %s from **%s** to **%s**, released %s.\n", packageName, summary.CurrentVersion, summary.LatestVersion, released)
+	case summary.LatestVersion != "":
+		fmt.Fprintf(&b, "At **%s**, released %s.\n", summary.LatestVersion, released)
+	}
+	if summary.Error != "" {
+		fmt.Fprintf(&b, "\n```\n%s\n```\n", summary.Error)
+	}
+
+	arches := make([]string, 0, len(summary.SourceSHA256))
+	for arch := range summary.SourceSHA256 {
+		arches = append(arches, arch)
+	}
+	sort.Strings(arches)
+	if len(arches) > 0 || summary.BuildURL != "" {
+		b.WriteString("\n")
+	}
+	for _, arch := range arches {
+		fmt.Fprintf(&b, "- Source SHA-256 (%s): `%s`\n", arch, summary.SourceSHA256[arch])
+	}
+	if summary.BuildURL != "" {
+		fmt.Fprintf(&b, "- COPR build: [%s](%s)\n", summary.BuildID, summary.BuildURL)
+	}
+
+	if notes := strings.TrimSpace(summary.ReleaseNotes); notes != "" {
+		fmt.Fprintf(&b, "\n<details>\n<summary>Release notes for %s</summary>\n\n%s\n\n</details>\n", summary.LatestVersion, notes)
+	}
+	return b.String()
+}
+
+// WriteGitHubOutput appends the run's step outputs to the file named by
+// $GITHUB_OUTPUT when running in GitHub Actions, and does nothing otherwise
+func writeGitHubOutput(summary *RunSummary) error {
+	path := os.Getenv("GITHUB_OUTPUT")
+	if path == "" {
+		return nil
+	}
+
+	newVersion := ""
+	if summary.Updated {
+		newVersion = summary.LatestVersion
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening GITHUB_OUTPUT: %v", err)
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "new_version=%s\nupdated=%t\nbuild_id=%s\n", newVersion, summary.Updated, summary.BuildID)
+	return file.Close()
+}
+
+// Logger prints progress messages. In quiet mode the messages are held back
+// until flush is called, so runs with nothing to do produce no output. A log
+// file gets every message straight away, without ANSI escape sequences, as
+// does w unless color is set.
+type Logger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	file    io.Writer
+	quiet   bool
+	debug   bool
+	explain bool
+	color   bool
+	held    bytes.Buffer
+}
+
+// MessageColors are the ANSI colors of messages starting with each prefix,
+// used when color is enabled
+var messageColors = []struct{ prefix, code string }{
+	{"Warning:", "33"},
+	{"Error", "31"},
+	{"FAIL ", "31"},
+	{"OK ", "32"},
+}
+
+// Colorize colors a message by its prefix, leaving others unchanged
+func colorize(message string) string {
+	for _, c := range messageColors {
+		if strings.HasPrefix(message, c.prefix) {
+			body := strings.TrimSuffix(message, "\n")
+			return "\x1b[" + c.code + "m" + body + "\x1b[0m" + message[len(body):]
+		}
+	}
+	return message
+}
+
+// ColorEnabled decides whether output to w is colored: always, never, or
+// with auto only when w is a terminal and NO_COLOR is unset
+func colorEnabled(mode string, w io.Writer) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// AnsiRegex matches ANSI escape sequences such as color codes, and
+// jsonANSIRegex the same once escaped in a JSON string
+var (
+	ansiRegex     = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+	jsonANSIRegex = regexp.MustCompile(`\\u001b\[[0-9;?]*[ -/]*[@-~]`)
+)
+
+// StripANSI removes ANSI escape sequences from text
+func stripANSI(text string) string {
+	return ansiRegex.ReplaceAllString(text, "")
+}
+
+var out = &Logger{w: os.Stdout}
+
+// Printf formats and prints a progress message, with secrets redacted
+func (l *Logger) Printf(format string, a ...interface{}) {
+	message := redactor.redact(fmt.Sprintf(format, a...))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		io.WriteString(l.file, stripANSI(message))
+	}
+	if l.color {
+		message = colorize(message)
+	} else {
+		message = stripANSI(message)
+	}
+	if l.quiet {
+		l.held.WriteString(message)
+		return
+	}
+	io.WriteString(l.w, message)
+}
+
+// Println prints a progress message followed by a newline
+func (l *Logger) Println(a ...interface{}) {
+	l.Printf("%s", fmt.Sprintln(a...))
+}
+
+// Debugf prints a debugging message when --debug is set
+func (l *Logger) Debugf(format string, a ...interface{}) {
+	if l.debug {
+		l.Printf("debug: "+format, a...)
+	}
+}
+
+// Explainf narrates a decision and why it was made when --explain is set
+func (l *Logger) Explainf(format string, a ...interface{}) {
+	if l.explain {
+		l.Printf("explain: "+format+"\n", a...)
+	}
+}
+
+// Flush writes any held back messages and stops holding further ones
+func (l *Logger) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(l.held.Bytes())
+	l.held.Reset()
+	l.quiet = false
+}
+
+// Redactor masks secrets in text that is logged or reported
+type Redactor struct {
+	enabled bool
+	secrets []string
+}
+
+var redactor = &Redactor{enabled: true}
+
+// Query parameters and URL credentials that carry secrets, such as GitHub
+// tokens and the signature of a presigned S3 URL
+var secretParamRegex = regexp.MustCompile(`(?i)([?&](?:access_token|token|sig|signature|password|x-amz-signature|x-amz-credential|x-amz-security-token)=)[^&\s"'<>]+`)
+var urlCredentialsRegex = regexp.MustCompile(`(://[^/\s:@]+:)[^@\s/]+@`)
+
+// Add registers a secret value to mask. Very short values are ignored so
+// common words are not masked everywhere.
+func (r *Redactor) add(secret string) {
+	if len(secret) >= 8 {
+		r.secrets = append(r.secrets, secret)
+	}
+}
+
+// AddFromEnv registers the values of environment variables whose names
+// mark them as secrets, such as GITHUB_TOKEN or SMTP_PASSWORD
+func (r *Redactor) addFromEnv() {
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		name = strings.ToUpper(name)
+		for _, suffix := range []string{"TOKEN", "SECRET", "PASSWORD", "KEY", "WEBHOOK", "WEBHOOK_URL"} {
+			if strings.HasSuffix(name, suffix) {
+				r.add(value)
+				break
+			}
+		}
+	}
+}
+
+// Redact returns text with known secrets and secret URL parts masked
+func (r *Redactor) redact(text string) string {
+	if !r.enabled {
+		return text
+	}
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, "[REDACTED]")
+	}
+	text = secretParamRegex.ReplaceAllString(text, "${1}[REDACTED]")
+	return urlCredentialsRegex.ReplaceAllString(text, "${1}[REDACTED]@")
+}
+
+// Get the RPM build path, supporting different environments
+func getRpmbuildPath() (string, error) {
+	// First check if RPM_BUILD_ROOT environment variable is set
+	if rpmBuildRoot, exists := os.LookupEnv("RPM_BUILD_ROOT"); exists {
+		if err := checkRpmBuildRoot(rpmBuildRoot); err != nil {
+			return "", fmt.Errorf("invalid RPM_BUILD_ROOT: %v", err)
+		}
+		return rpmBuildRoot, nil
+	}
+
+	// For GitHub Actions running in Fedora container
+	if _, err := os.Stat("/root/rpmbuild"); err == nil {
+		return "/root/rpmbuild", nil
+	}
+
+	// Default to user's home directory
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Error getting home directory: %v", err)
+	}
+	return filepath.Join(homeDir, "rpmbuild"), nil
+}
+
+// CheckRpmBuildRoot confirms path is a directory, or could be created as one
+// because its parent is
+func checkRpmBuildRoot(path string) error {
+	if path == "" {
+		return fmt.Errorf("set but empty")
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	parent := filepath.Dir(filepath.Clean(path))
+	if info, err := os.Stat(parent); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s does not exist and cannot be created, %s is not a directory", path, parent)
+	}
+	return nil
+}
+
+// RpmbuildSubdirs are the directories of an rpmbuild tree, as created by
+// rpmdev-setuptree
+var rpmbuildSubdirs = []string{"BUILD", "BUILDROOT", "RPMS", "SOURCES", "SPECS", "SRPMS"}
+
+// PrepareRpmbuildTree makes the rpmbuild tree at path usable, creating any
+// missing subdirectories like rpmdev-setuptree and checking each can be
+// written to, so an unusable tree fails up front rather than midway through
+// a build. It returns the tree's absolute path with symlinks resolved.
+func prepareRpmbuildTree(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid rpmbuild tree %s: %v", path, err)
+	}
+	for _, subdir := range rpmbuildSubdirs {
+		dir := filepath.Join(path, subdir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("rpmbuild tree %s is unusable: %v", path, err)
+		}
+		probe, err := os.CreateTemp(dir, ".zen-browser-write-test-*")
+		if err != nil {
+			return "", fmt.Errorf("rpmbuild tree %s is unusable: %s is not writable: %v", path, dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path, nil
+}
+
+// GetLatestRelease fetches the latest release from GitHub and resolves the
+// release information for each of the requested architectures. It returns
+// nil when there is nothing to build, with ErrTwilightSkipped for a twilight
+// release. A release whose assets are still uploading is not ready yet and
+// also returns nil, so the run exits 0 and checks it again next time.
+func getLatestRelease(opts *Options, state *State) ([]ReleaseInfo, error) {
+	arches, err := archList(opts.Arch)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := fetchLatestRelease(state, opts.GitHubToken, opts.RateLimitWait)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not modified since the cached validators were stored
+	if release == nil {
+		out.Println("Latest release unchanged since the last check")
+		out.Explainf("GitHub answered 304 Not Modified to the ETag and Last-Modified from the state file, so there is nothing new to act on")
+		return nil, nil
+	}
+	out.Explainf("latest tag is %s (%s, %s)", release.TagName, releaseKind(release), releaseAge(release.PublishedAt, time.Now()))
+
+	// The latest release is judged like any release in the list, and only
+	// what happens to a rejected one differs
+	_, rejected := selectRelease([]GitHubRelease{*release}, opts, arches)
+	if len(rejected) == 0 {
+		return resolveReleases(release, arches, opts.VersionPrefix, opts.FilenameFrom)
+	}
+	rejection := rejected[0]
+	switch rejection.Kind {
+	case ErrTwilightSkipped:
+		out.Printf("Skipping twilight/nightly build version: %s\n", release.TagName)
+		out.Explainf("%s contains a \"t\", which marks a twilight build; only stable releases are packaged", release.TagName)
+		return nil, ErrTwilightSkipped
+
+	// Manually blocked releases wait for the next upstream version, unless
+	// an earlier acceptable one should be built meanwhile
+	case errVersionSkipped:
+		out.Printf("Skipping version %s %s\n", release.TagName, rejection.Reason)
+		if !opts.SkipToPrevious {
+			out.Explainf("%s is in --skip-versions and --skip-to-previous is off, so waiting for the next release", release.TagName)
+			return nil, nil
+		}
+		out.Explainf("%s is in --skip-versions and --skip-to-previous is on, so looking for the newest acceptable earlier release", release.TagName)
+		return previousRelease(opts, arches)
+
+	// A release with missing assets may still be uploading
+	case ErrNotReady:
+		out.Printf("Release %s is %s\n", release.TagName, rejection.Reason)
+		out.Explainf("%s is %s, so it is probably still uploading and will be checked again next run", release.TagName, rejection.Reason)
+		// Forget the validators so the next run fetches the release again
+		if state != nil {
+			state.ETag = ""
+			state.LastModified = ""
+		}
+		return nil, nil
+
+	case ErrNoAsset:
+		out.Explainf("%s has %s, so there is nothing to build", release.TagName, rejection.Reason)
+		return nil, fmt.Errorf("%w for %s in release %s", ErrNoAsset, strings.Join(arches, ", "), release.TagName)
+	}
+	out.Printf("Skipping release %s: %s\n", release.TagName, rejection.Reason)
+	return nil, nil
+}
+
+// ReleaseKind describes a GitHub release as a draft, a prerelease or by its
+// channel, for --explain
+func releaseKind(release *GitHubRelease) string {
+	switch {
+	case release.Draft:
+		return "draft"
+	case release.Prerelease:
+		return "prerelease"
+	}
+	return releaseChannel(release.TagName)
+}
+
+// ReleaseAge says how long before now a release was published, for
+// --explain
+func releaseAge(publishedAt string, now time.Time) string {
+	published, ok := parsePublishedAt(publishedAt)
+	if !ok {
+		return "publication time unknown"
+	}
+	age := now.Sub(published)
+	switch {
+	case age >= 48*time.Hour:
+		return fmt.Sprintf("published %dd ago", int(age.Hours()/24))
+	case age >= 2*time.Hour:
+		return fmt.Sprintf("published %dh ago", int(age.Hours()))
+	case age >= 0:
+		return fmt.Sprintf("published %dm ago", int(age.Minutes()))
+	}
+	return "published in the future"
+}
+
+// MaxReleasePages bounds how far back previousRelease looks, in pages of
+// 100 releases
+const maxReleasePages = 3
+
+// PreviousRelease walks back through the release list for the newest
+// acceptable release, logging why newer ones were passed over
+func previousRelease(opts *Options, arches []string) ([]ReleaseInfo, error) {
+	for page := 1; page <= maxReleasePages; page++ {
+		list, err := fetchReleaseList(page, opts.GitHubToken)
+		if err != nil {
+			return nil, err
+		}
+		release, rejected := selectRelease(list, opts, arches)
+		for _, r := range rejected {
+			out.Debugf("Passing over release %s: %s\n", r.Tag, r.Reason)
+		}
+		if release != nil {
+			out.Printf("Using release %s, the newest not skipped (%d newer passed over on this page)\n", release.TagName, len(rejected))
+			releases, err := resolveReleases(release, arches, opts.VersionPrefix, opts.FilenameFrom)
+			for i := range releases {
+				releases[i].Fallback = true
+			}
+			return releases, err
+		}
+		if len(list) < 100 {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no acceptable release found among the recent releases")
+}
+
+// SelectRelease picks the newest acceptable release from a list ordered
+// newest first, returning it (or nil if there is none) along with why each
+// newer release was rejected. A release is acceptable when it is not a draft,
+// prerelease or twilight build, not listed in --skip-versions, has the assets
+// --min-assets and --require-assets ask for, and has a Linux tarball for at
+// least one of arches.
+func selectRelease(releases []GitHubRelease, opts *Options, arches []string) (*GitHubRelease, []RejectedRelease) {
+	var rejected []RejectedRelease
+	for i := range releases {
+		rejection := releaseRejection(&releases[i], opts, arches)
+		if rejection == nil {
+			return &releases[i], rejected
+		}
+		rejected = append(rejected, *rejection)
+	}
+	return nil, rejected
+}
+
+// ErrVersionSkipped is the kind of a rejection for a release listed in
+// --skip-versions
+var errVersionSkipped = errors.New("listed in --skip-versions")
+
+// ReleaseRejection returns why a release cannot be built, or nil if it can
+func releaseRejection(release *GitHubRelease, opts *Options, arches []string) *RejectedRelease {
+	reject := func(kind error, reason string) *RejectedRelease {
+		return &RejectedRelease{Tag: release.TagName, Reason: reason, Kind: kind}
+	}
+	switch {
+	case release.Draft:
+		return reject(nil, "draft")
+	case release.Prerelease:
+		return reject(nil, "prerelease")
+	case strings.Contains(release.TagName, "t"):
+		return reject(ErrTwilightSkipped, "twilight/nightly build")
+	case releaseSkipped(release, opts):
+		return reject(errVersionSkipped, errVersionSkipped.Error())
+	}
+	if reason := releaseNotReady(release, opts.MinAssets, opts.RequireAssets); reason != "" {
+		return reject(ErrNotReady, "not ready yet: "+reason)
+	}
+	for _, arch := range arches {
+		for _, asset := range release.Assets {
+			if asset.Name == fmt.Sprintf("zen.linux-%s.tar.xz", arch) && asset.DownloadURL != "" {
+				return nil
+			}
+		}
+	}
+	return reject(ErrNoAsset, "no Linux tarball for "+strings.Join(arches, ", "))
+}
+
+// ReleaseSkipped reports whether a release's tag or RPM version is listed in
+// --skip-versions
+func releaseSkipped(release *GitHubRelease, opts *Options) bool {
+	return versionSkipped(release.TagName, opts.SkipVersions) || versionSkipped(rpmVersion(release.TagName, opts.VersionPrefix), opts.SkipVersions)
+}
+
+// VersionSkipped reports whether version appears in the comma-separated
+// skipVersions list
+func versionSkipped(version, skipVersions string) bool {
+	for _, skip := range strings.Split(skipVersions, ",") {
+		if skip = strings.TrimSpace(skip); skip != "" && skip == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseNotReady checks a release against the expected asset count and
+// required asset names, returning why it is incomplete or "" if it is ready
+func releaseNotReady(release *GitHubRelease, minAssets int, requireAssets string) string {
+	if len(release.Assets) < minAssets {
+		return fmt.Sprintf("%d assets published, expected at least %d", len(release.Assets), minAssets)
+	}
+
+	var missing []string
+	for _, name := range strings.Split(requireAssets, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, asset := range release.Assets {
+			if asset.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "missing required assets " + strings.Join(missing, ", ")
+	}
+	return ""
+}
+
+// FetchLatestRelease fetches the raw latest release from the GitHub API.
+// With a state, the request is made conditional on both the cached ETag and
+// Last-Modified, since some intermediaries only honor one of them; a 304
+// returns a nil release. The state is updated from a 200 response. A
+// secondary rate limit whose Retry-After is at most maxWait, set with
+// --rate-limit-wait, is waited out and the request retried once.
+func fetchLatestRelease(state *State, token string, maxWait time.Duration) (*GitHubRelease, error) {
+	release, err := fetchLatestReleaseOnce(state, token)
+	var limitErr *RateLimitError
+	if errors.As(err, &limitErr) && limitErr.Secondary && maxWait > 0 && limitErr.RetryAfter <= maxWait {
+		out.Printf("GitHub API secondary rate limit hit, waiting %s before retrying\n", limitErr.RetryAfter)
+		sleep(limitErr.RetryAfter)
+		release, err = fetchLatestReleaseOnce(state, token)
+	}
+	return release, err
+}
+
+// FetchLatestReleaseOnce makes a single latest release request
+func fetchLatestReleaseOnce(state *State, token string) (*GitHubRelease, error) {
+	req, err := http.NewRequest(http.MethodGet, githubAPIURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing GitHub API: %v", err)
+	}
+	setGitHubHeaders(req, token)
+	if state != nil && state.ETag != "" {
+		req.Header.Set("If-None-Match", state.ETag)
+	}
+	if state != nil && state.LastModified != "" {
+		req.Header.Set("If-Modified-Since", state.LastModified)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing GitHub API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if limitErr := rateLimitError(resp, body); limitErr != nil {
+			return nil, limitErr
+		}
+		return nil, fmt.Errorf("error accessing GitHub API: %d", resp.StatusCode)
+	}
+
+	body, err := readAPIResponse(resp.Body, maxAPIResponseSize)
+	if err != nil {
+		return nil, err
+	}
+	var release GitHubRelease
+	if err := json.Unmarshal(body, &release); err != nil {
+		out.Debugf("raw GitHub API response:\n%s\n", body)
+		return nil, fmt.Errorf("error parsing GitHub API response: %v", err)
+	}
+
+	// Unknown fields decode to nothing, so a changed API would otherwise
+	// look like an empty release
+	if release.TagName == "" || len(release.Assets) == 0 {
+		out.Debugf("raw GitHub API response:\n%s\n", body)
+		return nil, fmt.Errorf("unexpected API response shape: tag_name %q with %d assets (rerun with --debug to see the response)",
+			release.TagName, len(release.Assets))
+	}
+
+	if state != nil {
+		state.ETag = resp.Header.Get("ETag")
+		state.LastModified = resp.Header.Get("Last-Modified")
+	}
+
+	return &release, nil
+}
+
+// Caps on GitHub API response bodies, so a runaway or hostile response is
+// rejected instead of exhausting memory. A page of the release list holds up
+// to 100 releases, each with its assets and notes.
+const (
+	maxAPIResponseSize = 10 << 20
+	maxReleaseListSize = 50 << 20
+)
+
+// ReadAPIResponse reads an API response body of at most limit bytes,
+// failing with ErrResponseTooLarge on a longer one
+func readAPIResponse(body io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading GitHub API response: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: over %s", ErrResponseTooLarge, formatSize(limit))
+	}
+	return data, nil
+}
+
+// Failure kinds that callers tell apart with errors.Is. ErrTwilightSkipped
+// and ErrUpToDate mean there is nothing to build and never fail a run; see
+// nothingToDo.
+var (
+	ErrNoAsset          = errors.New("no Linux asset")
+	ErrResponseTooLarge = errors.New("API response too large")
+	ErrTwilightSkipped  = errors.New("twilight release skipped")
+	ErrUpToDate         = errors.New("already at the latest version")
+	ErrUpdateAvailable  = errors.New("update available")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrBuildFailed      = errors.New("error building SRPM")
+	ErrRpmlintFailed    = errors.New("rpmlint failed")
+	ErrSubmitFailed     = errors.New("error submitting to COPR")
+	ErrCoprAuth         = errors.New("not authenticated to COPR")
+	ErrHookFailed       = errors.New("hook failed")
+	ErrNotReady         = errors.New("release not ready")
+	ErrSizeRegression   = errors.New("tarball much smaller than the previous one")
+)
+
+// Exit statuses, documented in the README
+const (
+	exitOK              = 0
+	exitError           = 1
+	exitUsage           = 2
+	exitFrozen          = 3
+	exitUpdateAvailable = 10
+	exitNetwork         = 20
+	exitNotReady        = 21
+	exitNoAsset         = 22
+	exitChecksum        = 23
+	exitSizeRegression  = 24
+	exitBuild           = 30
+	exitRpmlint         = 31
+	exitSubmit          = 40
+	exitCoprAuth        = 41
+	exitHook            = 42
+	exitInterrupted     = 130
+)
+
+// NothingToDo reports whether a run ended without anything to build, which
+// is not a failure
+func nothingToDo(err error) bool {
+	return errors.Is(err, ErrUpToDate) || errors.Is(err, ErrTwilightSkipped)
+}
+
+// ExitCode maps the outcome of a run to the process exit status
+func exitCode(err error) int {
+	var freezeErr *FreezeError
+	var limitErr *RateLimitError
+	var urlErr *url.Error
+	switch {
+	case err == nil, nothingToDo(err):
+		return exitOK
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.As(err, &freezeErr):
+		return exitFrozen
+	case errors.Is(err, ErrUpdateAvailable):
+		return exitUpdateAvailable
+	case errors.As(err, &limitErr), errors.As(err, &urlErr):
+		return exitNetwork
+	case errors.Is(err, ErrNotReady):
+		return exitNotReady
+	case errors.Is(err, ErrNoAsset):
+		return exitNoAsset
+	case errors.Is(err, ErrChecksumMismatch):
+		return exitChecksum
+	case errors.Is(err, ErrSizeRegression):
+		return exitSizeRegression
+	case errors.Is(err, ErrBuildFailed):
+		return exitBuild
+	case errors.Is(err, ErrRpmlintFailed):
+		return exitRpmlint
+	case errors.Is(err, ErrSubmitFailed):
+		return exitSubmit
+	case errors.Is(err, ErrCoprAuth):
+		return exitCoprAuth
+	case errors.Is(err, ErrHookFailed):
+		return exitHook
+	default:
+		return exitError
+	}
+}
+
+// FreezeError reports an update held back by --freeze-until
+type FreezeError struct {
+	Version string
+	Until   time.Time
+}
+
+func (e *FreezeError) Error() string {
+	return fmt.Sprintf("update to %s available but in freeze window until %s", e.Version, e.Until.Format(time.RFC3339))
+}
+
+// RateLimitError is a GitHub API response refused by a rate limit. The
+// primary limit is a quota that resets at a fixed time; a secondary limit
+// guards against bursts and asks the client to back off for RetryAfter.
+type RateLimitError struct {
+	Secondary  bool
+	RetryAfter time.Duration
+	Reset      time.Time
+	Message    string
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Secondary {
+		return fmt.Sprintf("GitHub API secondary rate limit hit (%s), retry after %s", e.Message, e.RetryAfter)
+	}
+	if e.Reset.IsZero() {
+		return fmt.Sprintf("GitHub API rate limit exceeded (%s)", e.Message)
+	}
+	return fmt.Sprintf("GitHub API rate limit exceeded (%s), resets at %s", e.Message, e.Reset.Format(time.RFC3339))
+}
+
+// ParseRetryAfter reads a Retry-After header given either as a number of
+// seconds or as an HTTP date. A date in the past means no wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait.Round(time.Second), true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// RateLimitError classifies a 403 or 429 response as a primary or secondary
+// rate limit, returning nil for any other failure. The primary limit reports
+// X-RateLimit-Remaining: 0; a secondary limit sends Retry-After or says so in
+// its message, and without Retry-After GitHub asks for at least a minute.
+func rateLimitError(resp *http.Response, body []byte) *RateLimitError {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+
+	var apiError struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(body, &apiError)
+	message := apiError.Message
+	if message == "" {
+		message = strings.TrimSpace(string(body))
+	}
+
+	retryAfter := resp.Header.Get("Retry-After")
+	if retryAfter != "" || strings.Contains(strings.ToLower(message), "secondary rate limit") {
+		wait, ok := parseRetryAfter(retryAfter, time.Now())
+		if !ok {
+			wait = time.Minute
+		}
+		return &RateLimitError{Secondary: true, RetryAfter: wait, Message: message}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		limitErr := &RateLimitError{Message: message}
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			limitErr.Reset = time.Unix(reset, 0)
+		}
+		return limitErr
+	}
+	return nil
+}
+
+// ParsePublishedAt parses a release's published_at, reporting false when it
+// is missing or malformed
+func parsePublishedAt(value string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
+
+// VersionTransformRules are the rules --version-transform can apply to a tag
+var versionTransformRules = map[string]func(string) string{
+	// 1.2.3-beta.1 becomes 1.2.3~beta.1, which RPM sorts before 1.2.3
+	"replace-dash-with-tilde": func(v string) string { return strings.ReplaceAll(v, "-", "~") },
+	// 1.2.3-1 becomes 1.2.3_1
+	"replace-dash-with-underscore": func(v string) string { return strings.ReplaceAll(v, "-", "_") },
+	// 1.14.5b becomes 1.14.5: letters after the last digit are dropped
+	"strip-suffix": func(v string) string {
+		return strings.TrimRightFunc(v, func(r rune) bool { return !(r >= '0' && r <= '9') })
+	},
+	"lowercase": strings.ToLower,
+}
+
+// Rules from --version-transform, applied in order by rpmVersion
+var versionTransforms []string
+
+// ParseVersionTransforms splits a comma-separated list of rule names,
+// rejecting unknown ones
+func parseVersionTransforms(value string) ([]string, error) {
+	var rules []string
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if _, ok := versionTransformRules[rule]; !ok {
+			return nil, fmt.Errorf("invalid --version-transform rule %q", rule)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// RpmVersion turns a release tag into a valid RPM version: the prefix, such
+// as the "v" of "v1.2.3", is removed, the --version-transform rules are
+// applied, and anything from the first character RPM does not allow in a
+// version, such as a "-", is dropped
+func rpmVersion(tag, prefix string) string {
+	version := strings.TrimPrefix(tag, prefix)
+	for _, rule := range versionTransforms {
+		version = versionTransformRules[rule](version)
+	}
+	if i := strings.IndexFunc(version, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._+~^", r))
+	}); i >= 0 {
+		version = version[:i]
+	}
+	return version
+}
+
+// FetchReleaseList fetches one page of releases, newest first; page 1 holds
+// the most recent 100
+func fetchReleaseList(page int, token string) ([]GitHubRelease, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s&page=%d", githubReleasesURL, page), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing GitHub API: %v", err)
+	}
+	setGitHubHeaders(req, token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing GitHub API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if limitErr := rateLimitError(resp, body); limitErr != nil {
+			return nil, limitErr
+		}
+		return nil, fmt.Errorf("error accessing GitHub API: %d", resp.StatusCode)
+	}
+
+	body, err := readAPIResponse(resp.Body, maxReleaseListSize)
+	if err != nil {
+		return nil, err
+	}
+	var releases []GitHubRelease
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return nil, fmt.Errorf("error parsing GitHub release list: %v", err)
+	}
+	return releases, nil
+}
+
+// ReleasesBetween returns the versions of the stable releases after previous
+// up to and including latest, newest first, from a release list ordered
+// newest first. Tags are turned into versions with versionPrefix. When
+// previous is not in the list the range is unknown, so only latest is
+// returned along with false.
+func releasesBetween(releases []GitHubRelease, versionPrefix, previous, latest string) ([]string, bool) {
+	var versions []string
+	started := false
+	for _, release := range releases {
+		version := rpmVersion(release.TagName, versionPrefix)
+		if version == latest {
+			started = true
+		}
+		if !started || strings.Contains(release.TagName, "t") {
+			continue
+		}
+		if version == previous {
+			return versions, true
+		}
+		versions = append(versions, version)
+	}
+	return []string{latest}, false
+}
+
+// IntermediateChangelog builds a changelog message with an "Update to" line
+// for every release after previous up to latest. When the release list is
+// unavailable it falls back to a line for latest alone.
+func intermediateChangelog(versionPrefix, previous, latest, token string) string {
+	releases, err := fetchReleaseList(1, token)
+	if err != nil {
+		out.Printf("Warning: could not list releases for the changelog: %v\n", err)
+		return "Update to " + latest
+	}
+	tags, found := releasesBetween(releases, versionPrefix, previous, latest)
+	if !found {
+		out.Printf("Warning: %s is not among the recent releases, the changelog only lists %s\n", previous, latest)
+	}
+	if len(tags) > 1 {
+		out.Printf("Changelog covers %d releases since %s\n", len(tags), previous)
+	}
+
+	// One list item per release; the template's own "- " starts the first
+	lines := make([]string, len(tags))
+	for i, tag := range tags {
+		lines[i] = "Update to " + tag
+	}
+	return strings.Join(lines, "\n- ")
+}
+
+// CheckSourceURL validates --source-url and the --source-version and
+// --source-sha256 flags that go with it
+func checkSourceURL(opts *Options) error {
+	if opts.SourceURL == "" {
+		if opts.SourceVersion != "" || opts.SourceSHA256 != "" {
+			return fmt.Errorf("--source-version and --source-sha256 need --source-url")
+		}
+		return nil
+	}
+	u, err := url.Parse(opts.SourceURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --source-url %q: expected an http or https URL", opts.SourceURL)
+	}
+	if urlBasename(opts.SourceURL) == "" {
+		return fmt.Errorf("--source-url %s has no file name", opts.SourceURL)
+	}
+	if opts.SourceVersion == "" {
+		return fmt.Errorf("--source-url needs --source-version")
+	}
+	if rpmVersion(opts.SourceVersion, opts.VersionPrefix) == "" {
+		return fmt.Errorf("--source-version %q is not a valid RPM version", opts.SourceVersion)
+	}
+	if opts.SourceSHA256 != "" && !regexp.MustCompile(`^[0-9a-fA-F]{64}$`).MatchString(opts.SourceSHA256) {
+		return fmt.Errorf("invalid --source-sha256 %q: expected a SHA-256 in hex", opts.SourceSHA256)
+	}
+	if opts.Arch == "all" {
+		return fmt.Errorf("--source-url needs a single --arch")
+	}
+	if opts.SourceFile != "" {
+		return fmt.Errorf("--source-url and --source-file cannot be combined")
+	}
+	return nil
+}
+
+// SourceURLRelease describes the tarball at --source-url as a release of
+// --source-version, so it goes through the same download and build steps as one
+// from GitHub. The expected checksum is only known from --source-sha256.
+func sourceURLRelease(opts *Options) ([]ReleaseInfo, error) {
+	arches, err := archList(opts.Arch)
+	if err != nil {
+		return nil, err
+	}
+	arch := arches[0]
+
+	version := rpmVersion(opts.SourceVersion, opts.VersionPrefix)
+	if version != opts.SourceVersion {
+		out.Printf("Using version %s for %s\n", version, opts.SourceVersion)
+	}
+
+	localName := fmt.Sprintf("zen.linux-%s.tar.xz", arch)
+	if opts.FilenameFrom == "url" {
+		localName = urlBasename(opts.SourceURL)
+	}
+	out.Printf("Building %s %s from %s instead of a release\n", arch, version, opts.SourceURL)
+
+	return []ReleaseInfo{{
+		Arch:        arch,
+		Version:     version,
+		Tag:         opts.SourceVersion,
+		DownloadURL: opts.SourceURL,
+		Filename:    localName,
+		AssetName:   urlBasename(opts.SourceURL),
+		SHA256:      strings.ToLower(opts.SourceSHA256),
+	}}, nil
+}
+
+// ResolveReleases builds one ReleaseInfo per architecture from a single
+// release payload. A single requested arch must be present; when several are
+// requested, missing ones are skipped as long as at least one is found.
+func resolveReleases(release *GitHubRelease, arches []string, versionPrefix, filenameFrom string) ([]ReleaseInfo, error) {
+	// The publication time is informational, so a bad one is only noted
+	publishedAt := release.PublishedAt
+	if _, ok := parsePublishedAt(publishedAt); !ok {
+		out.Printf("Warning: release %s has no valid published_at (%q), publication time unknown\n", release.TagName, publishedAt)
+		publishedAt = ""
+	}
+
+	version := rpmVersion(release.TagName, versionPrefix)
+	if version == "" {
+		return nil, fmt.Errorf("release tag %q does not contain a valid RPM version", release.TagName)
+	}
+	if version != release.TagName {
+		out.Printf("Using version %s for tag %s\n", version, release.TagName)
+		out.Explainf("RPM version %s comes from tag %s after removing the %q prefix and applying any --version-transform", version, release.TagName, versionPrefix)
+	}
+
+	var releases []ReleaseInfo
+	for _, arch := range arches {
+		// Find the Linux asset for this arch; its URL is taken from the
+		// asset list rather than built from the tag
+		filename := fmt.Sprintf("zen.linux-%s.tar.xz", arch)
+		var linuxAsset *Asset
+		for i, asset := range release.Assets {
+			if asset.Name == filename {
+				linuxAsset = &release.Assets[i]
+				break
+			}
+		}
+
+		if linuxAsset == nil || linuxAsset.DownloadURL == "" {
+			out.Explainf("no asset named %s in %s, so there is nothing to build for %s", filename, release.TagName, arch)
+			if len(arches) == 1 {
+				return nil, fmt.Errorf("%w for %s in the release", ErrNoAsset, arch)
+			}
+			out.Printf("No Linux %s asset in release %s, skipping\n", arch, version)
+			continue
+		}
+
+		out.Explainf("asset %s matched for %s", linuxAsset.Name, arch)
+		localName := linuxAsset.Name
+		if filenameFrom == "url" {
+			localName = urlBasename(linuxAsset.DownloadURL)
+			if localName == "" {
+				return nil, fmt.Errorf("download URL %s has no file name", linuxAsset.DownloadURL)
+			}
+		}
+
+		releases = append(releases, ReleaseInfo{
+			Arch:        arch,
+			Version:     version,
+			Tag:         release.TagName,
+			DownloadURL: linuxAsset.DownloadURL,
+			Filename:    localName,
+			AssetName:   linuxAsset.Name,
+			Size:        linuxAsset.Size,
+			PublishedAt: publishedAt,
+			ChecksumURL: findChecksumAsset(release.Assets, filename),
+			SHA256:      assetSHA256(linuxAsset.Digest),
+			Notes:       release.Body,
+		})
+	}
+
+	if len(releases) == 0 {
+		return nil, fmt.Errorf("%w for any of %s in the release", ErrNoAsset, strings.Join(arches, ", "))
+	}
+
+	return releases, nil
+}
+
+// UrlBasename returns the unescaped last path element of a URL, or "" if
+// there is none
+func urlBasename(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// AssetSHA256 returns the SHA-256 from an asset's digest, or "" if the
+// digest is missing or of another kind
+func assetSHA256(digest string) string {
+	sum, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || !regexp.MustCompile(`^[0-9a-fA-F]{64}$`).MatchString(sum) {
+		return ""
+	}
+	return strings.ToLower(sum)
+}
+
+// FindChecksumAsset returns the URL of the asset holding the checksum of
+// filename, preferring a dedicated .sha256 file over a shared manifest
+func findChecksumAsset(assets []Asset, filename string) string {
+	for _, asset := range assets {
+		if asset.Name == filename+".sha256" {
+			return asset.DownloadURL
+		}
+	}
+	for _, name := range checksumManifestNames {
+		for _, asset := range assets {
+			if strings.EqualFold(asset.Name, name) {
+				return asset.DownloadURL
+			}
+		}
+	}
+	return ""
+}
+
+// FetchChecksum downloads the checksum manifest of a release and returns the
+// SHA-256 listed for its tarball
+func fetchChecksum(release ReleaseInfo) (string, error) {
+	resp, err := httpClient.Get(release.ChecksumURL)
+	if err != nil {
+		return "", fmt.Errorf("error downloading checksum manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading checksum manifest: %d", resp.StatusCode)
+	}
+
+	manifest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading checksum manifest: %v", err)
+	}
+
+	// Manifests list the assets by their name in the release
+	name := release.AssetName
+	if name == "" {
+		name = release.Filename
+	}
+	checksum := parseChecksumManifest(string(manifest), name)
+	if checksum == "" {
+		return "", fmt.Errorf("no checksum for %s in checksum manifest", name)
+	}
+	return checksum, nil
+}
+
+// ParseChecksumManifest finds the SHA-256 of filename in sha256sum style
+// output ("<hash>  <name>" or "<hash> *<name>"). A manifest holding a single
+// bare hash is taken to be for filename.
+func parseChecksumManifest(manifest, filename string) string {
+	hashRegex := regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	scanner := bufio.NewScanner(strings.NewReader(manifest))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !hashRegex.MatchString(fields[0]) {
+			continue
+		}
+		if len(fields) == 1 || filepath.Base(strings.TrimPrefix(fields[1], "*")) == filename {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+// SpecTarget is a spec file together with the per-arch releases it packages
+type SpecTarget struct {
+	SpecFile string
+	Releases []ReleaseInfo
+}
+
+// GroupBySpec assigns each release to its spec file. An arch uses
+// zen-browser-<arch>.spec when present, otherwise the shared zen-browser.spec,
+// which is then expected to carry a Source line per arch.
+func groupBySpec(specsDir string, releases []ReleaseInfo) []SpecTarget {
+	var targets []SpecTarget
+	index := make(map[string]int)
+	for _, release := range releases {
+		specFile := filepath.Join(specsDir, "zen-browser.spec")
+		archSpec := filepath.Join(specsDir, fmt.Sprintf("zen-browser-%s.spec", release.Arch))
+		if _, err := os.Stat(archSpec); err == nil {
+			specFile = archSpec
+		}
+
+		if i, ok := index[specFile]; ok {
+			targets[i].Releases = append(targets[i].Releases, release)
+			continue
+		}
+		index[specFile] = len(targets)
+		targets = append(targets, SpecTarget{SpecFile: specFile, Releases: []ReleaseInfo{release}})
+	}
+	return targets
+}
+
+// CoprProject resolves the COPR project the target's SRPM is submitted to.
+// A shared spec builds several arches in one SRPM, so it cannot use {arch}.
+func (t SpecTarget) coprProject(template string) (string, error) {
+	arch := t.Releases[0].Arch
+	if len(t.Releases) > 1 {
+		if strings.Contains(template, "{arch}") {
+			return "", fmt.Errorf("COPR project %q uses {arch} but %s builds several arches; add per-arch spec files", template, filepath.Base(t.SpecFile))
+		}
+		arch = ""
+	}
+	return resolveCoprProject(template, releaseChannel(t.Releases[0].Version), arch)
+}
+
+// UpdateSpecFile updates the spec file with the new version information and
+// adds a changelog entry with the message. All releases share a version;
+// each one updates its arch's Source line.
+func updateSpecFile(specFilePath string, releases []ReleaseInfo, message string, changelog ChangelogConfig) error {
+	content, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading spec file: %v", err)
+	}
+	releaseInfo := releases[0]
+
+	// The spec is edited as raw bytes: only matched lines are rewritten and
+	// nothing is transcoded, so non-UTF-8 content such as Latin-1 changelog
+	// author names is written back unchanged. Replacements are literal so a
+	// '$' in a version or URL is never expanded.
+
+	// Update main version
+	updatedContent := string(setSpecVersion(content, releaseInfo.Version))
+
+	// A new version starts again at release 1
+	updatedContent = setSpecRelease(updatedContent, 1)
+
+	// Update Source URLs
+	for _, release := range releases {
+		updatedContent = updateSourceURL(updatedContent, release, len(releases) == 1)
+	}
+
+	// Update desktop entry version
+	updatedContent = updateDesktopEntryVersion(updatedContent, releaseInfo.Version)
+
+	// Add new changelog entry
+	updatedContent, err = addChangelogEntry(updatedContent, releaseInfo.Version+"-"+specRelease(updatedContent), message, changelog)
+	if err != nil {
+		return err
+	}
+
+	// Write the updated content back
+	return os.WriteFile(specFilePath, []byte(updatedContent), 0644)
+}
+
+// BumpSpecRelease increments the Release of an unchanged version and adds a
+// changelog entry explaining the rebuild
+func bumpSpecRelease(specFilePath, message string, changelog ChangelogConfig) error {
+	content, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading spec file: %v", err)
+	}
+
+	version, found := readSpecVersion(content)
+	releaseRegex := regexp.MustCompile(`Release:\s+(\d+)`)
+	releaseMatches := releaseRegex.FindStringSubmatch(string(content))
+	if !found || len(releaseMatches) < 2 {
+		return fmt.Errorf("could not find Version and numeric Release in spec file")
+	}
+
+	release, _ := strconv.Atoi(releaseMatches[1])
+	updatedContent := setSpecRelease(string(content), release+1)
+	updatedContent, err = addChangelogEntry(updatedContent, version+"-"+specRelease(updatedContent), message, changelog)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(specFilePath, []byte(updatedContent), 0644)
+}
+
+// SetSpecFields applies Name=Value assignments to the spec. A name matches a
+// tag line such as "Release:" or the macro of a %global or %define line
+// ("commit" or "%global commit"), and must exist in the spec.
+func setSpecFields(specFilePath string, fields []string) error {
+	content, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading spec file: %v", err)
+	}
+
+	for _, field := range fields {
+		name, value, _ := strings.Cut(field, "=")
+		name = strings.TrimSpace(name)
+		tagRegex := regexp.MustCompile(`(?mi)^(` + regexp.QuoteMeta(name) + `:\s*)[^\r\n]*`)
+		macro := strings.TrimPrefix(strings.TrimPrefix(name, "%global "), "%define ")
+		macroRegex := regexp.MustCompile(`(?m)^(%(?:global|define)\s+` + regexp.QuoteMeta(strings.TrimSpace(macro)) + `\s+)[^\r\n]*`)
+
+		replacement := []byte("${1}" + strings.ReplaceAll(value, "$", "$$"))
+		switch {
+		case tagRegex.Match(content):
+			content = tagRegex.ReplaceAll(content, replacement)
+		case macroRegex.Match(content):
+			content = macroRegex.ReplaceAll(content, replacement)
+		default:
+			return fmt.Errorf("--set-field %s: no such tag or macro in %s", name, filepath.Base(specFilePath))
+		}
+		out.Printf("Set %s to %s\n", name, value)
+	}
+
+	return os.WriteFile(specFilePath, content, 0644)
+}
+
+// ReleaseNotesFile is the name under which --ship-changelog saves the
+// upstream release notes in SOURCES and installs them as %doc
+const releaseNotesFile = "zen-browser-RELEASE-NOTES.md"
+
+// ShipReleaseNotes saves the release notes to SOURCES and makes the spec
+// ship them as %doc
+func shipReleaseNotes(specFilePath, sourcesDir string, release ReleaseInfo) error {
+	notes := strings.TrimSpace(release.Notes)
+	if notes == "" {
+		notes = fmt.Sprintf("No release notes were published for Zen Browser %s.", release.Version)
+	}
+	if err := os.WriteFile(filepath.Join(sourcesDir, releaseNotesFile), []byte(notes+"\n"), 0644); err != nil {
+		return fmt.Errorf("error saving release notes: %v", err)
+	}
+
+	content, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading spec file: %v", err)
+	}
+	updated, err := addDocSource(string(content), releaseNotesFile)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(specFilePath, []byte(updated), 0644)
+}
+
+// AddDocSource makes the spec install a file from SOURCES as %doc: a
+// numbered Source line for it, a %prep line copying it into the build
+// directory and a %doc line in %files. Parts already present are left
+// alone, so running it again changes nothing.
+func addDocSource(content, name string) (string, error) {
+	sourceRegex := regexp.MustCompile(`(?m)^Source(\d*):[ \t]*(.*?)[ \t]*\r?$`)
+	number := -1
+	highest := -1
+	lastSource := -1
+	for _, m := range sourceRegex.FindAllStringSubmatchIndex(content, -1) {
+		n := 0
+		if m[3] > m[2] {
+			n, _ = strconv.Atoi(content[m[2]:m[3]])
+		}
+		if content[m[4]:m[5]] == name {
+			number = n
+		}
+		if n > highest {
+			highest = n
+		}
+		lastSource = m[1]
+	}
+	if lastSource < 0 {
+		return "", fmt.Errorf("no Source line in spec file to add %s after", name)
+	}
+	if number < 0 {
+		number = highest + 1
+		line := fmt.Sprintf("\n%-15s %s", fmt.Sprintf("Source%d:", number), name)
+		content = content[:lastSource] + line + content[lastSource:]
+	}
+
+	copyLine := fmt.Sprintf("cp -p %%{SOURCE%d} .", number)
+	if !strings.Contains(content, copyLine) {
+		setupRegex := regexp.MustCompile(`(?m)^%(?:autosetup|setup)\b.*$`)
+		prepRegex := regexp.MustCompile(`(?m)^%prep\b.*$`)
+		loc := setupRegex.FindStringIndex(content)
+		if loc == nil {
+			loc = prepRegex.FindStringIndex(content)
+		}
+		if loc == nil {
+			return "", fmt.Errorf("no %%prep section in spec file to copy %s in", name)
+		}
+		content = content[:loc[1]] + "\n" + copyLine + content[loc[1]:]
+	}
+
+	docRegex := regexp.MustCompile(`(?m)^%doc\s+` + regexp.QuoteMeta(name) + `\s*$`)
+	if !docRegex.MatchString(content) {
+		loc := regexp.MustCompile(`(?m)^%files\b.*$`).FindStringIndex(content)
+		if loc == nil {
+			return "", fmt.Errorf("no %%files section in spec file to add %s to", name)
+		}
+		content = content[:loc[1]] + "\n%doc " + name + content[loc[1]:]
+	}
+	return content, nil
+}
+
+// SetSpecRelease sets the number of the Release tag, keeping any suffix
+// such as %{?dist}
+func setSpecRelease(content string, release int) string {
+	releaseRegex := regexp.MustCompile(`(Release:\s+)\d+`)
+	return releaseRegex.ReplaceAllString(content, fmt.Sprintf("${1}%d", release))
+}
+
+// SpecRelease returns the number of the spec's Release tag, without a suffix
+// such as %{?dist}, for the changelog entry; "1" if there is none
+func specRelease(content string) string {
+	if m := regexp.MustCompile(`Release:\s+(\d+)`).FindStringSubmatch(content); m != nil {
+		return m[1]
+	}
+	return "1"
+}
+
+// ChangelogEntry holds the fields available to the changelog template
+type ChangelogEntry struct {
+	Date    string
+	Author  string
+	Version string
+	Body    string
+}
+
+// DefaultChangelogTemplate is the built-in changelog entry format
+const defaultChangelogTemplate = "* {{.Date}} {{.Author}} - {{.Version}}\n- {{.Body}}\n"
+
+// ChangelogConfig says how new changelog entries are written
+type ChangelogConfig struct {
+	// Template renders each entry; --changelog-template replaces the
+	// built-in one
+	Template *template.Template
+	// Author is the "Name <email>" author of each entry
+	Author string
+	// Footer is added as the last item of each entry, set by
+	// --changelog-footer; "" adds nothing
+	Footer string
+	// Location is the time zone entries are dated in, set with --timezone
+	Location *time.Location
+	// MaxEntries is the number of entries kept when adding one, 0 for all;
+	// set with --max-changelog-entries
+	MaxEntries int
+}
+
+// NewChangelogConfig sets up changelog entries as the options ask
+func newChangelogConfig(opts *Options) (ChangelogConfig, error) {
+	changelog := ChangelogConfig{
+		Template:   template.Must(template.New("changelog").Parse(defaultChangelogTemplate)),
+		Author:     formatChangelogAuthor(opts.ChangelogName, opts.ChangelogEmail),
+		Location:   time.UTC,
+		MaxEntries: opts.MaxChangelogEntries,
+	}
+	if opts.ChangelogTemplate != "" {
+		var err error
+		if changelog.Template, err = loadChangelogTemplate(opts.ChangelogTemplate); err != nil {
+			return ChangelogConfig{}, err
+		}
+	}
+	if opts.ChangelogFooter {
+		changelog.Footer = buildFooter()
+	}
+	if opts.Timezone != nil {
+		changelog.Location = opts.Timezone
+	}
+	return changelog, nil
+}
+
+// Default author of changelog entries, replaced with --changelog-name and
+// --changelog-email
+const (
+	defaultChangelogName  = "COPR Build System"
+	defaultChangelogEmail = "copr-build@fedoraproject.org"
+)
+
+// EmailRegex matches a plain email address, without a display name
+var emailRegex = regexp.MustCompile(`^[^@\s<>]+@[^@\s<>.]+(\.[^@\s<>.]+)+$`)
+
+// CheckChangelogAuthor validates --changelog-name and --changelog-email
+func checkChangelogAuthor(name, email string) error {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "<>\n") {
+		return fmt.Errorf("invalid --changelog-name %q: expected a non-empty name without <, > or newlines", name)
+	}
+	if !emailRegex.MatchString(email) {
+		return fmt.Errorf("invalid --changelog-email %q: expected an address like user@example.com", email)
+	}
+	return nil
+}
+
+// FormatChangelogAuthor renders a changelog author as "Name <email>", with %
+// escaped so rpm does not expand it as a macro
+func formatChangelogAuthor(name, email string) string {
+	author := fmt.Sprintf("%s <%s>", strings.TrimSpace(name), email)
+	return strings.ReplaceAll(author, "%", "%%")
+}
+
+// BuildFooter describes the tool and host producing a changelog entry, with
+// % escaped so rpm does not expand it as a macro
+func buildFooter() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown host"
+	}
+	footer := fmt.Sprintf("Built by update-zen-browser %s on %s", toolVersion, host)
+	return strings.ReplaceAll(footer, "%", "%%")
+}
+
+// LoadChangelogTemplate parses a changelog template file and renders it
+// once with sample data so mistakes are reported before anything is changed
+func loadChangelogTemplate(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading changelog template: %v", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing changelog template: %v", err)
+	}
+	sample := ChangelogEntry{Date: "Mon Jan 2 2006", Author: "Packager", Version: "1.0-1", Body: "Update to 1.0"}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("error rendering changelog template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// AddChangelogEntry prepends an entry, written as changelog says, to the
+// %changelog section
+func addChangelogEntry(content, versionRelease, message string, changelog ChangelogConfig) (string, error) {
+	entry := ChangelogEntry{
+		Date:    time.Now().In(changelog.Location).Format("Mon Jan 2 2006"),
+		Author:  changelog.Author,
+		Version: versionRelease,
+		Body:    message,
+	}
+	var rendered strings.Builder
+	if err := changelog.Template.Execute(&rendered, entry); err != nil {
+		return "", fmt.Errorf("error rendering changelog entry: %v", err)
+	}
+	changelogEntry := "%changelog\n" + strings.TrimRight(rendered.String(), "\n") + "\n"
+	if changelog.Footer != "" {
+		changelogEntry += "- " + changelog.Footer + "\n"
+	}
+	changelogRegex := regexp.MustCompile(`%changelog.*`)
+	content = changelogRegex.ReplaceAllLiteralString(content, changelogEntry)
+	if changelog.MaxEntries > 0 {
+		content = trimChangelog(content, changelog.MaxEntries)
+	}
+	return content, nil
+}
+
+// ChangelogItems turns text into a changelog message with one "- " item per
+// non-empty line. Lines may already start with "- ". The template supplies
+// the first item's "- ".
+func changelogItems(text string) string {
+	var items []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "- "))
+		if line != "" {
+			items = append(items, line)
+		}
+	}
+	return strings.Join(items, "\n- ")
+}
+
+// TrimChangelog keeps the newest max entries of the %changelog section,
+// which runs to the end of the spec. An entry starts at a line beginning
+// with "* "; the blank line before a dropped entry goes with it.
+func trimChangelog(content string, max int) string {
+	start := regexp.MustCompile(`(?m)^%changelog`).FindStringIndex(content)
+	if start == nil {
+		return content
+	}
+	entries := regexp.MustCompile(`(?m)^\* `).FindAllStringIndex(content[start[1]:], -1)
+	if len(entries) <= max {
+		return content
+	}
+	cut := start[1] + entries[max][0]
+	return strings.TrimRight(content[:cut], "\r\n") + "\n"
+}
+
+// UpdateSourceURL points the Source line for the release's arch at its
+// download URL. A multi-arch spec is expected to have a SourceN line per arch,
+// recognised by the arch in its URL; a single-arch spec falls back to Source0.
+func updateSourceURL(content string, release ReleaseInfo, fallbackToSource0 bool) string {
+	sourceRegex := regexp.MustCompile(`(?m)^(Source\d*):(\s+)(.*linux-` + regexp.QuoteMeta(release.Arch) + `\.tar\.xz.*)$`)
+	if sourceRegex.MatchString(content) {
+		return sourceRegex.ReplaceAllString(content, "${1}:${2}"+strings.ReplaceAll(release.DownloadURL, "$", "$$"))
+	}
+	if !fallbackToSource0 {
+		out.Printf("Warning: no Source line for %s in spec file\n", release.Arch)
+		return content
+	}
+
+	sourceRegex = regexp.MustCompile(`Source0:\s+.*`)
+	return sourceRegex.ReplaceAllLiteralString(content, "Source0:        "+release.DownloadURL)
+}
+
+// SourceLine returns the name and value of the spec's Source line for the
+// release's arch, as updateSourceURL finds it, or "" if there is none
+func sourceLine(content string, release ReleaseInfo, fallbackToSource0 bool) (string, string) {
+	sourceRegex := regexp.MustCompile(`(?m)^(Source\d*):\s+(.*linux-` + regexp.QuoteMeta(release.Arch) + `\.tar\.xz.*?)\s*$`)
+	if m := sourceRegex.FindStringSubmatch(content); m != nil {
+		return m[1], m[2]
+	}
+	if fallbackToSource0 {
+		if m := regexp.MustCompile(`(?m)^Source0:\s+(.*?)\s*$`).FindStringSubmatch(content); m != nil {
+			return "Source0", m[1]
+		}
+	}
+	return "", ""
+}
+
+// SourceBasename is the file name rpmbuild looks for in SOURCES for a Source
+// value: the part after a "#/" fragment if there is one, otherwise the last
+// path element
+func sourceBasename(value string) string {
+	if _, name, ok := strings.Cut(value, "#/"); ok {
+		return name
+	}
+	if i := strings.IndexAny(value, "?#"); i >= 0 && strings.Contains(value, "://") {
+		value = value[:i]
+	}
+	return value[strings.LastIndex(value, "/")+1:]
+}
+
+// CheckSourceNames confirms that each release's Source line names the file
+// downloaded into SOURCES, since rpmbuild would otherwise fail to find it.
+// On a mismatch align says what to do: "file" renames the tarball to the
+// Source name, "spec" adds a "#/<file>" fragment to the Source line, and ""
+// fails with both names.
+func checkSourceNames(specFilePath, sourcesDir string, releases []ReleaseInfo, align string) error {
+	content, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading spec file: %v", err)
+	}
+	updated := string(content)
+	for _, release := range releases {
+		name, value := sourceLine(updated, release, len(releases) == 1)
+		if name == "" {
+			continue
+		}
+		// Names built from macros can't be compared without expanding them
+		expected := sourceBasename(value)
+		if expected == release.Filename || strings.Contains(expected, "%") {
+			continue
+		}
+
+		switch align {
+		case "file":
+			out.Printf("Renaming %s to %s to match %s\n", release.Filename, expected, name)
+			if err := os.Rename(filepath.Join(sourcesDir, release.Filename), filepath.Join(sourcesDir, expected)); err != nil {
+				return fmt.Errorf("error renaming source: %v", err)
+			}
+		case "spec":
+			out.Printf("Pointing %s at %s\n", name, release.Filename)
+			base, _, _ := strings.Cut(value, "#")
+			lineRegex := regexp.MustCompile(`(?m)^(` + name + `:\s+)` + regexp.QuoteMeta(value))
+			updated = lineRegex.ReplaceAllString(updated, "${1}"+strings.ReplaceAll(base+"#/"+release.Filename, "$", "$$"))
+		default:
+			return fmt.Errorf("%s names %s but the tarball was saved as %s; rpmbuild would not find it (use --align-source-name file or spec)",
+				name, expected, release.Filename)
+		}
+	}
+	if updated != string(content) {
+		return os.WriteFile(specFilePath, []byte(updated), 0644)
+	}
+	return nil
+}
+
+// UpdateDesktopEntryVersion sets the Version= key of the [Desktop Entry]
+// section. The key does not need to follow the section header directly, and
+// CRLF line endings and surrounding whitespace are preserved.
+func updateDesktopEntryVersion(content, version string) string {
+	desktopEntryRegex := regexp.MustCompile(`^[ \t]*\[Desktop Entry\][ \t]*\r?\n?$`)
+	versionKeyRegex := regexp.MustCompile(`^([ \t]*)Version[ \t]*=.*?(\r?\n?)$`)
+
+	lines := strings.SplitAfter(content, "\n")
+	inSection := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case desktopEntryRegex.MatchString(line):
+			inSection = true
+		case !inSection:
+			continue
+		case strings.HasPrefix(trimmed, "[") || trimmed == "EOF":
+			// Next section or end of the heredoc without a Version key
+			inSection = false
+		default:
+			if m := versionKeyRegex.FindStringSubmatch(line); m != nil {
+				lines[i] = m[1] + "Version=" + version + m[2]
+				inSection = false
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// DownloadSource downloads the source tarball and returns its path and
+// SHA-256. Unless fresh is set, a file already in SOURCES is reused when it
+// matches the release's expected checksum or, without one, cachedSHA256; a
+// new download is verified against the expected checksum.
+func downloadSource(ctx context.Context, cfg *RunConfig, sourcesDir string, release ReleaseInfo, cachedSHA256 string, fresh bool) (string, string, DownloadStats, error) {
+	// Ensure the SOURCES directory exists
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		return "", "", DownloadStats{}, fmt.Errorf("error creating SOURCES directory: %v", err)
+	}
+
+	sourcePath := filepath.Join(sourcesDir, release.Filename)
+
+	known := release.SHA256
+	if known == "" {
+		known = cachedSHA256
+	}
+	if known != "" && !fresh {
+		if checksum, err := fileSHA256(sourcePath); err == nil && checksum == known {
+			out.Printf("Reusing cached %s (checksum %s)\n", release.Filename, checksum)
+			return sourcePath, checksum, DownloadStats{}, nil
+		}
+	}
+
+	size, err := checkAsset(ctx, &release)
+	if err != nil {
+		return "", "", DownloadStats{}, err
+	}
+	if size >= 0 {
+		out.Printf("%s is %s\n", release.Filename, formatSize(size))
+	}
+
+	// Download the file, again if a mismatch looks like transient corruption.
+	// It only replaces the one in SOURCES once complete.
+	staged := cfg.stagingPath(sourcePath)
+	var mismatches []string
+	var stats DownloadStats
+	for {
+		start := time.Now()
+		checksum, err := downloadOnce(ctx, cfg.Downloader, release.DownloadURL, staged)
+		if err != nil {
+			return "", "", DownloadStats{}, err
+		}
+		stats.add(staged, time.Since(start))
+		if release.SHA256 == "" || checksum == release.SHA256 {
+			if release.SHA256 != "" {
+				out.Printf("Verified checksum of %s\n", release.Filename)
+			}
+			if err := moveFile(staged, sourcePath); err != nil {
+				return "", "", DownloadStats{}, fmt.Errorf("error saving source file: %v", err)
+			}
+			return sourcePath, checksum, stats, nil
+		}
+
+		os.Remove(staged)
+		mismatches = append(mismatches, checksum)
+		if len(mismatches) > cfg.ChecksumRetries {
+			return "", "", DownloadStats{}, checksumMismatchError(release, mismatches)
+		}
+		out.Printf("Checksum mismatch for %s (got %s), downloading again (retry %d of %d)\n",
+			release.Filename, checksum, len(mismatches), cfg.ChecksumRetries)
+	}
+}
+
+// RemoveWorkDir deletes the run's temporary directory when it ends, or with
+// keep only says where it was left
+func (cfg *RunConfig) removeWorkDir(keep bool) {
+	if cfg.WorkDir == "" {
+		return
+	}
+	if keep {
+		out.Printf("Keeping the run's temporary files in %s (--keep-temp)\n", cfg.WorkDir)
+	} else if err := os.RemoveAll(cfg.WorkDir); err != nil {
+		out.Printf("Warning: could not remove %s: %v\n", cfg.WorkDir, err)
+	}
+	cfg.WorkDir = ""
+}
+
+// StagingPath returns where to write a file bound for dest: in the work
+// directory when there is one, else dest itself
+func (cfg *RunConfig) stagingPath(dest string) string {
+	if cfg.WorkDir == "" {
+		return dest
+	}
+	return filepath.Join(cfg.WorkDir, filepath.Base(dest))
+}
+
+// MoveFile moves a finished file into place by renaming it, which replaces
+// dest atomically. Across filesystems it is copied to a temporary file next
+// to dest first, which is then renamed.
+func moveFile(src, dest string) error {
+	if src == dest {
+		return nil
+	}
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// DownloadStats measures the downloads of a tarball, including any repeated
+// after a checksum mismatch
+type DownloadStats struct {
+	Bytes        int64   `json:"bytes"`
+	Seconds      float64 `json:"seconds"`
+	MiBPerSecond float64 `json:"mib_per_second"`
+}
+
+// Add counts a completed download of path that took d
+func (s *DownloadStats) add(path string, d time.Duration) {
+	if info, err := os.Stat(path); err == nil {
+		s.Bytes += info.Size()
+	}
+	s.Seconds += d.Seconds()
+	s.MiBPerSecond = throughput(s.Bytes, s.Seconds)
+}
+
+// Throughput is the average speed in MiB/s of moving bytes in seconds
+func throughput(bytes int64, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1024 * 1024) / seconds
+}
+
+// HeadAsset sends a HEAD request for a tarball before downloading it, so a
+// release whose asset is missing fails at once instead of after the GET. It
+// returns the size, or -1 if unknown. Servers that refuse HEAD, or a HEAD that
+// fails outright, leave the verdict to the GET.
+func headAsset(ctx context.Context, downloadURL string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, downloadURL, nil)
+	if err != nil {
+		return -1, nil
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		out.Debugf("HEAD %s failed, trying the download anyway: %v\n", downloadURL, err)
+		return -1, nil
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return -1, nil
+	default:
+		return 0, fmt.Errorf("%w: asset not available: %s returned %s", ErrNotReady, downloadURL, resp.Status)
+	}
+}
+
+// CheckAsset sends a release's HEAD request, unless an earlier step already
+// did, and returns the size it reported, or -1 if unknown. A size differing
+// from the one listed in the release fails at once, as an ErrNotReady.
+func checkAsset(ctx context.Context, release *ReleaseInfo) (int64, error) {
+	if !release.Checked {
+		size, err := headAsset(ctx, release.DownloadURL)
+		if err != nil {
+			return 0, err
+		}
+		release.ContentLength = size
+		release.Checked = true
+	}
+	if release.ContentLength >= 0 && release.Size > 0 && release.ContentLength != release.Size {
+		return 0, fmt.Errorf("%w: %s is %d bytes on the server but %d in the release", ErrNotReady, release.Filename, release.ContentLength, release.Size)
+	}
+	return release.ContentLength, nil
+}
+
+// DownloadOnce downloads url to dest with downloader and returns its SHA-256
+func downloadOnce(ctx context.Context, downloader Downloader, url, dest string) (string, error) {
+	// The downloader may hash the file on the way
+	checksum, err := downloader.Download(ctx, url, dest)
+	if err != nil {
+		return "", err
+	}
+	if checksum == "" {
+		return fileSHA256(dest)
+	}
+	return checksum, nil
+}
+
+// ChecksumMismatchError describes a tarball that never matched its expected
+// checksum. Getting the same wrong checksum on every attempt points at the
+// file having been changed upstream rather than at corruption in transit.
+func checksumMismatchError(release ReleaseInfo, got []string) error {
+	persistent := len(got) > 1
+	for _, checksum := range got[1:] {
+		if checksum != got[0] {
+			persistent = false
+		}
+	}
+	if persistent {
+		return fmt.Errorf("persistent %w for %s: expected %s, got %s on all %d downloads; the file was probably changed upstream",
+			ErrChecksumMismatch, release.Filename, release.SHA256, got[0], len(got))
+	}
+	return fmt.Errorf("%w for %s: expected %s, got %s after %d download(s)",
+		ErrChecksumMismatch, release.Filename, release.SHA256, strings.Join(got, ", "), len(got))
+}
+
+// Downloader fetches a URL into a local file. It returns the file's SHA-256
+// if it computed it while downloading, or "" if the caller has to.
+type Downloader interface {
+	Download(ctx context.Context, url, dest string) (string, error)
+}
+
+// HTTPDownloader downloads with the shared HTTP client
+type HTTPDownloader struct{}
+
+// Download streams the response body into dest
+func (d *HTTPDownloader) Download(ctx context.Context, url, dest string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error downloading source: %v", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error downloading source: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading source: %d", resp.StatusCode)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return "", fmt.Errorf("error creating source file: %v", err)
+	}
+	defer file.Close()
+
+	// Hash while writing so verifying the file needs no second read
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		return "", fmt.Errorf("error saving source file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("error saving source file: %v", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Aria2cDownloader downloads with the external aria2c tool, which can use
+// several connections per file. aria2c cannot prefer IPv4, so --prefer-ipv4
+// disables IPv6 for it.
+type Aria2cDownloader struct {
+	Path        string
+	DisableIPv6 bool
+}
+
+// Download runs aria2c to fetch url into dest
+func (d *Aria2cDownloader) Download(ctx context.Context, url, dest string) (string, error) {
+	args := []string{
+		"--dir", filepath.Dir(dest),
+		"--out", filepath.Base(dest),
+		"--allow-overwrite=true",
+		"--auto-file-renaming=false",
+		"--max-connection-per-server=4",
+		"--console-log-level=warn",
+	}
+	if d.DisableIPv6 {
+		args = append(args, "--disable-ipv6=true")
+	}
+	cmd := exec.CommandContext(ctx, d.Path, append(args, url)...)
+	traceCommand(cmd)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error downloading source with aria2c: %v\nOutput: %s", err, output.String())
+	}
+	return "", nil
+}
+
+// NewDownloader returns the downloader selected by name
+func newDownloader(name string, preferIPv4 bool) (Downloader, error) {
+	switch name {
+	case "http":
+		return &HTTPDownloader{}, nil
+	case "aria2c":
+		path, err := exec.LookPath("aria2c")
+		if err != nil {
+			return nil, fmt.Errorf("aria2c downloader requested but aria2c is not installed: %v", err)
+		}
+		return &Aria2cDownloader{Path: path, DisableIPv6: preferIPv4}, nil
+	default:
+		return nil, fmt.Errorf("unknown downloader: %s", name)
+	}
+}
+
+// UseSourceFile copies a local tarball into SOURCES under the release's
+// file name and returns its SHA-256
+func useSourceFile(sourceFile, sourcesDir string, release ReleaseInfo) (string, error) {
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		return "", fmt.Errorf("error creating SOURCES directory: %v", err)
+	}
+	sourcePath := filepath.Join(sourcesDir, release.Filename)
+
+	src, err := filepath.Abs(sourceFile)
+	if err != nil {
+		return "", err
+	}
+	if src != sourcePath {
+		if err := copyFile(src, sourcePath); err != nil {
+			return "", fmt.Errorf("error copying source file: %v", err)
+		}
+	}
+	return fileSHA256(sourcePath)
+}
+
+// VerifyInternalVersion checks that the version recorded in the tarball's
+// application.ini matches the release being built, catching a release whose
+// tag and assets disagree. platform.ini only holds the Gecko version, so it
+// cannot be used for this.
+func verifyInternalVersion(tarball string, release ReleaseInfo) error {
+	stdout, stderr, err := runCommand("tar", "-xOf", tarball, "--wildcards", "*/application.ini")
+	if err != nil {
+		return fmt.Errorf("error reading application.ini from %s: %v\n%s", filepath.Base(tarball), err, stderr)
+	}
+	internal := applicationVersion(stdout)
+	if internal == "" {
+		return fmt.Errorf("no Version in the [App] section of application.ini in %s", filepath.Base(tarball))
+	}
+	if internal != release.Version && internal != release.Tag {
+		return fmt.Errorf("version mismatch in %s: the release tag %s says %s but application.ini says %s; the release is probably mislabeled",
+			filepath.Base(tarball), release.Tag, release.Version, internal)
+	}
+	out.Printf("Verified application.ini version %s in %s\n", internal, filepath.Base(tarball))
+	return nil
+}
+
+// VerifyExtract extracts a tarball into a temporary directory, removed
+// afterwards, and checks it holds a single top-level directory with the zen
+// executable and application.ini, catching archives that decompress but
+// have a broken tar structure. The directory is made in workDir, or the
+// system temporary directory when it is "".
+func verifyExtract(tarball, workDir string) error {
+	dir, err := os.MkdirTemp(workDir, "zen-browser-extract-*")
+	if err != nil {
+		return fmt.Errorf("error creating extraction directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Base(tarball)
+	if _, stderr, err := runCommand("tar", "-xf", tarball, "-C", dir); err != nil {
+		return fmt.Errorf("%s does not extract: %v\n%s", name, err, stderr)
+	}
+
+	top, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading extracted %s: %v", name, err)
+	}
+	if len(top) != 1 || !top[0].IsDir() {
+		return fmt.Errorf("%s has %d top-level entries, expected a single directory", name, len(top))
+	}
+	root := filepath.Join(dir, top[0].Name())
+	for _, file := range []string{"zen", "application.ini"} {
+		if info, err := os.Stat(filepath.Join(root, file)); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("%s has no %s/%s", name, top[0].Name(), file)
+		}
+	}
+
+	entries := 0
+	if err := filepath.WalkDir(root, func(string, os.DirEntry, error) error {
+		entries++
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error reading extracted %s: %v", name, err)
+	}
+	out.Printf("Verified %s extracts (%d entries under %s/)\n", name, entries, top[0].Name())
+	return nil
+}
+
+// ApplicationVersion returns Version from the [App] section of an
+// application.ini, or "" if it has none
+func applicationVersion(ini string) string {
+	section := ""
+	for _, line := range strings.Split(ini, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok && section == "App" && strings.TrimSpace(key) == "Version" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// FileSHA256 returns the hex encoded SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	return fileHash(path, sha256.New())
+}
+
+// FileHash streams a file through hash and returns the hex encoded sum
+func fileHash(path string, h hash.Hash) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteSRPMChecksums hashes the SRPM, and writes each sum to a sidecar file
+// next to it in the format of sha256sum and sha512sum
+func writeSRPMChecksums(srpmPath string, sha512sum bool) (string, string, error) {
+	sum256, err := fileSHA256(srpmPath)
+	if err != nil {
+		return "", "", err
+	}
+	if err := writeChecksumFile(srpmPath+".sha256", sum256, srpmPath); err != nil {
+		return "", "", err
+	}
+	if !sha512sum {
+		return sum256, "", nil
+	}
+
+	sum512, err := fileHash(srpmPath, sha512.New())
+	if err != nil {
+		return "", "", err
+	}
+	if err := writeChecksumFile(srpmPath+".sha512", sum512, srpmPath); err != nil {
+		return "", "", err
+	}
+	return sum256, sum512, nil
+}
+
+// WriteChecksumFile writes a single "<sum>  <name>" line
+func writeChecksumFile(path, sum, target string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(target))
+	if err := os.WriteFile(path, []byte(line), 0644); err != nil {
+		return fmt.Errorf("error writing checksum file: %v", err)
+	}
+	return nil
+}
+
+// CheckFreeSpace fails when the filesystem holding dir has less room than
+// minFree plus the size of the tarballs about to be downloaded. Sizes are
+// taken from HEAD requests, whose results are kept in the releases for the
+// downloads, and a tarball of unknown size is not counted.
+func checkFreeSpace(ctx context.Context, dir string, minFree int64, releases []ReleaseInfo) error {
+	required := minFree
+	for i := range releases {
+		size, err := checkAsset(ctx, &releases[i])
+		if err != nil {
+			return err
+		}
+		if size > 0 {
+			required += size
+		}
+	}
+
+	// SOURCES may not exist yet, so look at the nearest existing parent
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return fmt.Errorf("error checking free space in %s: %v", dir, err)
+	}
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+	if available < required {
+		return fmt.Errorf("not enough free space in %s: %s available, %s needed (see --min-free-space)",
+			dir, formatSize(available), formatSize(required))
+	}
+	return nil
+}
+
+// FormatSize formats a byte count with a binary unit
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exp := float64(size)/unit, 0
+	for value >= unit && exp < 3 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[exp])
+}
+
+// CheckDownload confirms the download URL is reachable without fetching the
+// tarball and returns its size, or -1 if the server does not report one.
+// Servers that reject HEAD are retried with a single byte ranged GET.
+func checkDownload(downloadURL string) (int64, error) {
+	resp, err := httpClient.Head(downloadURL)
+	if err != nil {
+		return 0, fmt.Errorf("error checking download: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return resp.ContentLength, nil
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+		return 0, fmt.Errorf("error checking download: %d", resp.StatusCode)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error checking download: %v", err)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error checking download: %v", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/<total>
+		contentRange := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+			if size, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				return size, nil
+			}
+		}
+		return -1, nil
+	default:
+		return 0, fmt.Errorf("error checking download: %d", resp.StatusCode)
+	}
+}
+
+// BuildSRPM builds the SRPM package. The full rpmbuild output is written to
+// a log file when the build fails, or always with saveLog, and the log path
+// is returned alongside the SRPM path.
+func buildSRPM(cfg *RunConfig, specFilePath string, saveLog bool) (string, string, error) {
+	// The SRPM is written to the run's directory, where it can't be confused
+	// with one from a concurrent run, and then moved to SRPMS
+	srpmsDir := filepath.Join(filepath.Dir(filepath.Dir(specFilePath)), "SRPMS")
+	args := []string{"-bs", specFilePath}
+	buildDir := srpmsDir
+	if cfg.WorkDir != "" {
+		buildDir = filepath.Join(cfg.WorkDir, "SRPMS")
+		args = append([]string{"--define", "_srcrpmdir " + buildDir}, args...)
+	}
+
+	var stdout, stderr string
+	var err error
+	for attempt := 1; ; attempt++ {
+		stdout, stderr, err = runCommand("rpmbuild", args...)
+		if err == nil {
+			break
+		}
+		transient, reason := classifyBuildFailure(stderr, cfg.TransientPatterns)
+		if !transient {
+			out.Printf("rpmbuild failed, not retrying: %s\n", reason)
+			break
+		}
+		if attempt > cfg.RpmbuildRetries {
+			out.Printf("rpmbuild failed with a transient error (%s), giving up after %d attempts\n", reason, attempt)
+			break
+		}
+		out.Printf("rpmbuild failed with a transient error (%s), retrying (retry %d of %d)\n", reason, attempt, cfg.RpmbuildRetries)
+		sleep(time.Duration(attempt) * 10 * time.Second)
+	}
+
+	var logPath string
+	if err != nil || saveLog {
+		var logErr error
+		logDir := cfg.OutputDir
+		if logDir == "" {
+			logDir = cfg.WorkDir
+		}
+		logPath, logErr = writeBuildLog(logDir, specFilePath, stdout, stderr, err)
+		if logErr != nil {
+			out.Printf("Warning: could not save build log: %v\n", logErr)
+		} else if err == nil {
+			out.Printf("Build log saved to %s\n", logPath)
+		}
+	}
+
+	if err != nil {
+		if logPath != "" {
+			return "", logPath, fmt.Errorf("%w: %v\nStderr: %s\nFull log: %s", ErrBuildFailed, err, stderr, logPath)
+		}
+		return "", "", fmt.Errorf("%w: %v\nStderr: %s", ErrBuildFailed, err, stderr)
+	}
+
+	// Try to find the SRPM path from the output
+	srpmPath := findSRPMInOutput(stdout, stderr)
+	if srpmPath == "" && buildDir == srpmsDir {
+		srpmPath = findSRPMInSpec(specFilePath)
+	}
+	if srpmPath == "" {
+		srpmPath = findSRPMInDirectory(buildDir)
+	}
+
+	if srpmPath == "" {
+		return "", logPath, fmt.Errorf("%w: could not find built SRPM path in output\nStdout: %s\nStderr: %s",
+			ErrBuildFailed, stdout, stderr)
+	}
+
+	if buildDir != srpmsDir {
+		dest := filepath.Join(srpmsDir, filepath.Base(srpmPath))
+		if err := os.MkdirAll(srpmsDir, 0755); err != nil {
+			return "", logPath, fmt.Errorf("error creating SRPMS directory: %v", err)
+		}
+		if err := moveFile(srpmPath, dest); err != nil {
+			return "", logPath, fmt.Errorf("error moving SRPM to %s: %v", srpmsDir, err)
+		}
+		srpmPath = dest
+	}
+
+	out.Printf("Found SRPM: %s\n", srpmPath)
+	return srpmPath, logPath, nil
+}
+
+// DefaultTransientBuildPatterns match rpmbuild error output from failures
+// that may pass on a second try, such as a busy file or a network error
+// while fetching sources, to which --rpmbuild-transient-pattern adds. They
+// are deliberately narrow: retrying a spec error only wastes time.
+var defaultTransientBuildPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)resource temporarily unavailable`),
+	regexp.MustCompile(`(?i)text file busy`),
+	regexp.MustCompile(`(?i)can't create transaction lock`),
+	regexp.MustCompile(`(?i)temporary failure in name resolution`),
+	regexp.MustCompile(`(?i)could not resolve host`),
+	regexp.MustCompile(`(?i)connection (timed out|reset by peer)`),
+}
+
+// SpecErrorRegex matches rpmbuild's report of an error in the spec itself,
+// which never counts as transient
+var specErrorRegex = regexp.MustCompile(`(?m)^error: (line \d+|Bad source|Failed build dependencies|File not found)`)
+
+// ClassifyBuildFailure decides from rpmbuild's error output whether a failed
+// build is worth retrying, and says why
+func classifyBuildFailure(stderr string, patterns []*regexp.Regexp) (bool, string) {
+	if m := specErrorRegex.FindString(stderr); m != "" {
+		return false, fmt.Sprintf("spec error %q", m)
+	}
+	for _, pattern := range patterns {
+		if m := pattern.FindString(stderr); m != "" {
+			return true, fmt.Sprintf("matched %q", m)
+		}
+	}
+	return false, "no transient error recognized"
+}
+
+// WriteBuildLog saves the output of an rpmbuild run to a new file in dir,
+// or the system temporary directory if dir is "", and returns its path
+func writeBuildLog(dir, specFilePath, stdout, stderr string, buildErr error) (string, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	file, err := os.CreateTemp(dir, "zen-browser-rpmbuild-*.log")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	status := "succeeded"
+	if buildErr != nil {
+		status = "failed: " + buildErr.Error()
+	}
+	fmt.Fprintf(file, "$ rpmbuild -bs %s\n%s\n\n=== stdout ===\n%s\n=== stderr ===\n%s",
+		specFilePath, status, stdout, stderr)
+	return file.Name(), file.Close()
+}
+
+// RunRpmlint lints the SRPM and fails if it has findings at or above the
+// failOn level, not counting the diagnostic codes in ignore. A missing
+// rpmlint is skipped unless required.
+func runRpmlint(srpmPath, failOn string, require bool, ignore []string) error {
+	if _, err := exec.LookPath("rpmlint"); err != nil {
+		if require {
+			return fmt.Errorf("rpmlint is required but not installed")
+		}
+		out.Println("Warning: rpmlint is not installed, skipping lint")
+		return nil
+	}
+
+	// rpmlint exits non-zero when it reports errors, so the output decides
+	stdout, stderr, err := runCommand("rpmlint", strings.TrimPrefix(srpmPath, "Wrote: "))
+	diagnostics := parseRpmlintOutput(stdout)
+	if err != nil && len(diagnostics) == 0 {
+		return fmt.Errorf("error running rpmlint: %v\nStderr: %s", err, stderr)
+	}
+
+	diagnostics, ignored := filterRpmlintDiagnostics(diagnostics, ignore)
+	errorCount, warningCount := 0, 0
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Level == "E" {
+			errorCount++
+		} else {
+			warningCount++
+		}
+	}
+
+	if len(diagnostics) > 0 {
+		out.Printf("rpmlint reported %d errors and %d warnings:\n", errorCount, warningCount)
+		for _, diagnostic := range diagnostics {
+			out.Println(diagnostic.Line)
+		}
+	} else {
+		out.Println("rpmlint reported no problems")
+	}
+	if ignored > 0 {
+		out.Printf("Ignored %d rpmlint findings (--rpmlint-ignore)\n", ignored)
+	}
+
+	switch {
+	case failOn == "error" && errorCount > 0,
+		failOn == "warning" && errorCount+warningCount > 0:
+		return fmt.Errorf("%w: found %d errors and %d warnings", ErrRpmlintFailed, errorCount, warningCount)
+	}
+	return nil
+}
+
+// RpmlintDiagnostic is one finding of rpmlint, parsed from a line such as
+// "zen-browser.src: W: invalid-url Source0: https://..."
+type RpmlintDiagnostic struct {
+	Package string
+	Level   string
+	Code    string
+	Detail  string
+	Line    string
+}
+
+// ParseRpmlintOutput extracts the error and warning diagnostics from rpmlint
+// output, skipping its summary and informational lines
+func parseRpmlintOutput(output string) []RpmlintDiagnostic {
+	findingRegex := regexp.MustCompile(`^(\S+): ([EW]): (\S+)\s*(.*)$`)
+	var diagnostics []RpmlintDiagnostic
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		m := findingRegex.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		diagnostics = append(diagnostics, RpmlintDiagnostic{
+			Package: m[1],
+			Level:   m[2],
+			Code:    m[3],
+			Detail:  m[4],
+			Line:    m[0],
+		})
+	}
+	return diagnostics
+}
+
+// FilterRpmlintDiagnostics drops the diagnostics whose code is in ignore and
+// returns the rest along with how many were dropped
+func filterRpmlintDiagnostics(diagnostics []RpmlintDiagnostic, ignore []string) ([]RpmlintDiagnostic, int) {
+	var kept []RpmlintDiagnostic
+	for _, diagnostic := range diagnostics {
+		ignored := false
+		for _, code := range ignore {
+			if diagnostic.Code == code {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			kept = append(kept, diagnostic)
+		}
+	}
+	return kept, len(diagnostics) - len(kept)
+}
+
+// FindSRPMInOutput extracts SRPM path from command output
+func findSRPMInOutput(stdout, stderr string) string {
+	// First check stderr
+	scanner := bufio.NewScanner(strings.NewReader(stderr))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, ".src.rpm") {
+			return strings.TrimPrefix(strings.TrimSpace(line), "Wrote: ")
+		}
+	}
+
+	// Then check stdout
+	scanner = bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, ".src.rpm") {
+			return strings.TrimPrefix(strings.TrimSpace(line), "Wrote: ")
+		}
+	}
+
+	return ""
+}
+
+// FindSRPMInSpec finds SRPM based on spec file version info
+func findSRPMInSpec(specFilePath string) string {
+	content, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return ""
+	}
+
+	// Extract version
+	version, found := readSpecVersion(content)
+
+	// Extract release
+	releaseRegex := regexp.MustCompile(`Release:\s+(.*)`)
+	releaseMatches := releaseRegex.FindStringSubmatch(string(content))
+
+	if found && len(releaseMatches) > 1 {
+		release := strings.Replace(releaseMatches[1], "%{?dist}", ".fc41", 1)
+
+		srpmDir := filepath.Join(filepath.Dir(filepath.Dir(specFilePath)), "SRPMS")
+		expectedPath := filepath.Join(srpmDir, fmt.Sprintf("zen-browser-%s-%s.src.rpm", version, release))
+
+		if _, err := os.Stat(expectedPath); err == nil {
+			return expectedPath
+		}
+	}
+
+	return ""
+}
+
+// FindSRPMInDirectory finds most recent SRPM in SRPMS directory
+func findSRPMInDirectory(srpmsDir string) string {
+	if err := os.MkdirAll(srpmsDir, 0755); err != nil {
+		out.Printf("Error creating SRPMS directory: %v\n", err)
+		return ""
+	}
+
+	files, err := os.ReadDir(srpmsDir)
+	if err != nil {
+		out.Printf("Error listing SRPMS directory: %v\n", err)
+		return ""
+	}
+
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".src.rpm") {
+			out.Printf(" - %s\n", file.Name())
+			return filepath.Join(srpmsDir, file.Name())
+		}
+	}
+
+	return ""
+}
+
+// RunHook runs a hook command through sh with args as its positional
+// arguments and env added to its environment, printing its output. A
+// non-zero exit is returned as ErrHookFailed.
+func runHook(command string, env []string, args ...string) error {
+	out.Printf("Running hook: %s\n", strings.Join(append([]string{command}, args...), " "))
+	argv := append([]string{"sh", "-c", command + ` "$@"`, "hook"}, args...)
+	if len(env) > 0 {
+		argv = append(append([]string{"env"}, env...), argv...)
+	}
+	stdout, stderr, err := runCommand(argv[0], argv[1:]...)
+	if output := strings.TrimSpace(stdout + stderr); output != "" {
+		out.Println(output)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrHookFailed, command, err)
+	}
+	return nil
+}
+
+// CoprConfig is the copr-cli configuration holding the API token, set with
+// --copr-token-file; "" uses copr-cli's default ~/.config/copr
+var coprConfig string
+
+// CoprCLI runs copr-cli with the configured credentials
+func coprCLI(args ...string) (string, string, error) {
+	if coprConfig != "" {
+		args = append([]string{"--config", coprConfig}, args...)
+	}
+	return runCommand("copr-cli", args...)
+}
+
+// SubmitToCopr submits the SRPM to a COPR project for building and returns
+// the build ID. extra holds further copr-cli build options from
+// --copr-build-opts.
+func submitToCopr(project, srpmPath string, chroots []string, nowait bool, extra []string) (string, error) {
+	// Strip "Wrote: " prefix if present
+	srpmPath = strings.TrimPrefix(srpmPath, "Wrote: ")
+
+	out.Printf("Submitting %s to COPR project %s...\n", srpmPath, project)
+
+	args := []string{"build"}
+	if nowait {
+		args = append(args, "--nowait")
+	}
+	for _, chroot := range chroots {
+		args = append(args, "-r", chroot)
+	}
+	args = append(args, extra...)
+	stdout, stderr, err := coprCLI(append(args, project, srpmPath)...)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v\nStderr: %s", ErrSubmitFailed, err, stderr)
+	}
+
+	out.Printf("Successfully submitted to COPR: %s\n", stdout)
+
+	// Extract the build ID from the output
+	buildIDRegex := regexp.MustCompile(`Created builds: (\d+)`)
+	buildIDMatches := buildIDRegex.FindStringSubmatch(stdout)
+
+	var buildID string
+	if len(buildIDMatches) > 1 {
+		buildID = buildIDMatches[1]
+		out.Printf("Build ID: %s\n", buildID)
+		out.Printf("Build status URL: %s\n", coprBuildURL(buildID))
+	}
+
+	return buildID, nil
+}
+
+// CoprBuildOptions lists the copr-cli build options --copr-build-opts may
+// pass, with the pattern their value must match, or nil for a switch.
+// Options the tool sets itself, like -r and --nowait, are left out.
+var coprBuildOptions = map[string]*regexp.Regexp{
+	"--enable-net":     regexp.MustCompile(`^(on|off)$`),
+	"--background":     nil,
+	"--timeout":        regexp.MustCompile(`^[0-9]+$`),
+	"--isolation":      regexp.MustCompile(`^(default|simple|nspawn)$`),
+	"--bootstrap":      regexp.MustCompile(`^(unchanged|default|off|on|image)$`),
+	"--exclude-chroot": regexp.MustCompile(`^[a-z0-9._-]+$`),
+	"--after-build-id": regexp.MustCompile(`^[0-9]+$`),
+	"--with-build-id":  regexp.MustCompile(`^[0-9]+$`),
+}
+
+// CoprBuildOptionNames returns the allowed --copr-build-opts options, sorted
+func coprBuildOptionNames() []string {
+	var names []string
+	for name := range coprBuildOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCoprBuildOpts splits --copr-build-opts into copr-cli arguments,
+// accepting "--option value" and "--option=value", and rejects options not
+// in coprBuildOptions or values they do not take
+func parseCoprBuildOpts(value string) ([]string, error) {
+	var args []string
+	fields := strings.Fields(value)
+	for i := 0; i < len(fields); i++ {
+		name, optValue, hasValue := strings.Cut(fields[i], "=")
+		pattern, ok := coprBuildOptions[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid --copr-build-opts option %q: expected one of %s", name, strings.Join(coprBuildOptionNames(), ", "))
+		}
+		if pattern == nil {
+			if hasValue {
+				return nil, fmt.Errorf("invalid --copr-build-opts option %q: %s takes no value", fields[i], name)
+			}
+			args = append(args, name)
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("invalid --copr-build-opts option %q: missing value", name)
+			}
+			i++
+			optValue = fields[i]
+		}
+		if !pattern.MatchString(optValue) {
+			return nil, fmt.Errorf("invalid --copr-build-opts value %q for %s", optValue, name)
+		}
+		args = append(args, name, optValue)
+	}
+	return args, nil
+}
+
+// CoprBuildArgs returns the extra copr-cli build options for a run: those
+// from --copr-build-opts, plus --background with --copr-background
+func coprBuildArgs(opts *Options) []string {
+	args := append([]string{}, opts.CoprBuildOpts...)
+	if !opts.CoprBackground {
+		return args
+	}
+	for _, arg := range args {
+		if arg == "--background" {
+			return args
+		}
+	}
+	return append(args, "--background")
+}
+
+// ResolveChroots turns --chroots into the chroots to build for: nil for the
+// project's defaults, the listed ones, or with "auto" those currently
+// enabled in the project, looked up once per run and kept in projectChroots.
+// A failed lookup falls back to the defaults.
+func resolveChroots(spec, project string, projectChroots map[string][]string) []string {
+	var chroots []string
+	switch spec {
+	case "":
+		return nil
+	case "auto":
+		var ok bool
+		if chroots, ok = projectChroots[project]; !ok {
+			var err error
+			if chroots, err = coprProjectChroots(project); err != nil {
+				out.Printf("Warning: could not get the chroots of %s, using its defaults: %v\n", project, err)
+				return nil
+			}
+			projectChroots[project] = chroots
+		}
+	default:
+		for _, chroot := range strings.Split(spec, ",") {
+			if chroot = strings.TrimSpace(chroot); chroot != "" {
+				chroots = append(chroots, chroot)
+			}
+		}
+	}
+	out.Printf("Building for chroots: %s\n", strings.Join(chroots, ", "))
+	return chroots
+}
+
+// CoprProjectChroots asks the COPR API which chroots are enabled in project
+func coprProjectChroots(project string) ([]string, error) {
+	owner, name, ok := strings.Cut(project, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid COPR project %q, expected owner/project", project)
+	}
+
+	query := url.Values{"ownername": {owner}, "projectname": {name}}
+	resp, err := httpClient.Get(coprAPIURL + "/project?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("error accessing COPR API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error accessing COPR API: %d", resp.StatusCode)
+	}
+
+	var info struct {
+		ChrootRepos map[string]string `json:"chroot_repos"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error parsing COPR project: %v", err)
+	}
+	if len(info.ChrootRepos) == 0 {
+		return nil, fmt.Errorf("project %s has no enabled chroots", project)
+	}
+	chroots := make([]string, 0, len(info.ChrootRepos))
+	for chroot := range info.ChrootRepos {
+		chroots = append(chroots, chroot)
+	}
+	sort.Strings(chroots)
+	return chroots, nil
+}
+
+// CoprPollInterval is how often waitForCoprBuild checks a build's state,
+// replaceable in tests
+var coprPollInterval = 30 * time.Second
+
+// WaitForCoprBuild polls a COPR build until it ends, returning an
+// ErrSubmitFailed error unless it succeeded. With fetchLogs, the error of a
+// failed build includes an excerpt of its logs.
+func waitForCoprBuild(ctx context.Context, buildID string, fetchLogs bool) error {
+	if buildID == "" {
+		return fmt.Errorf("%w: no build ID to wait for", ErrSubmitFailed)
+	}
+	out.Printf("Waiting for COPR build %s...\n", buildID)
+	for {
+		stdout, stderr, err := coprCLI("status", buildID)
+		if err != nil {
+			return fmt.Errorf("%w: error checking build %s: %v\nStderr: %s", ErrSubmitFailed, buildID, err, stderr)
+		}
+		switch state := strings.TrimSpace(stdout); state {
+		case "succeeded":
+			out.Printf("COPR build %s succeeded\n", buildID)
+			return nil
+		case "failed":
+			err := fmt.Errorf("%w: build %s failed, see %s", ErrSubmitFailed, buildID, coprBuildURL(buildID))
+			if fetchLogs {
+				if excerpt := coprFailureLogs(buildID); excerpt != "" {
+					err = fmt.Errorf("%w\n%s", err, excerpt)
+				}
+			}
+			return err
+		case "canceled", "skipped":
+			return fmt.Errorf("%w: build %s %s, see %s", ErrSubmitFailed, buildID, state, coprBuildURL(buildID))
+		}
+		// An interrupt must not wait out the interval
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(coprPollInterval):
+		}
+	}
+}
+
+// MaxFailureLogLines caps the log excerpt of each failed chroot
+const maxFailureLogLines = 30
+
+// CoprLogNames are the logs of a failed chroot searched for errors, in order:
+// the package build itself, then the buildroot setup, which is where missing
+// build dependencies show up
+var coprLogNames = []string{"build.log.gz", "root.log.gz"}
+
+// FailureLineRegex matches the lines of a build log that explain a failure
+var failureLineRegex = regexp.MustCompile(`(?i)(\berrors?\b|\bfailed\b|no match for argument|nothing provides|bad exit status)`)
+
+// CoprFailureLogs returns an excerpt of the logs of each failed chroot of a
+// COPR build, or "" if none could be fetched. Problems fetching the logs
+// are only logged, since the build failure is what gets reported.
+func coprFailureLogs(buildID string) string {
+	chroots, err := coprFailedChroots(buildID)
+	if err != nil {
+		out.Printf("Warning: could not fetch the logs of build %s: %v\n", buildID, err)
+		return ""
+	}
+
+	var excerpts []string
+	for _, chroot := range chroots {
+		for _, name := range coprLogNames {
+			logURL := strings.TrimSuffix(chroot.ResultURL, "/") + "/" + name
+			text, err := fetchCoprLog(logURL)
+			if err != nil {
+				out.Debugf("Could not fetch %s: %v\n", logURL, err)
+				continue
+			}
+			if excerpt := logExcerpt(text, maxFailureLogLines); excerpt != "" {
+				excerpts = append(excerpts, fmt.Sprintf("%s %s:\n%s", chroot.Name, strings.TrimSuffix(name, ".gz"), excerpt))
+				break
+			}
+		}
+	}
+	return strings.Join(excerpts, "\n")
+}
+
+// CoprBuildChroot is a chroot of a COPR build, as listed by the API
+type CoprBuildChroot struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	ResultURL string `json:"result_url"`
+}
+
+// CoprFailedChroots asks the COPR API which chroots of a build failed
+func coprFailedChroots(buildID string) ([]CoprBuildChroot, error) {
+	query := url.Values{"build_id": {buildID}}
+	resp, err := httpClient.Get(coprAPIURL + "/build-chroot/list?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("error accessing COPR API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error accessing COPR API: %d", resp.StatusCode)
+	}
+
+	var list struct {
+		Items []CoprBuildChroot `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error parsing COPR build chroots: %v", err)
+	}
+	var failed []CoprBuildChroot
+	for _, chroot := range list.Items {
+		if chroot.State == "failed" && chroot.ResultURL != "" {
+			failed = append(failed, chroot)
+		}
+	}
+	return failed, nil
+}
+
+// FetchCoprLog downloads a COPR build log, decompressing it if gzipped.
+// Logs are read up to 32 MiB.
+func fetchCoprLog(logURL string) (string, error) {
+	resp, err := httpClient.Get(logURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	reader := bufio.NewReader(io.LimitReader(resp.Body, 32<<20))
+	var body io.Reader = reader
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, 32<<20)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// LogExcerpt returns the last limit lines of a build log that match
+// failureLineRegex, or its last limit lines if none do
+func logExcerpt(text string, limit int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	var matched []string
+	for _, line := range lines {
+		if failureLineRegex.MatchString(line) {
+			matched = append(matched, line)
+		}
+	}
+	if len(matched) == 0 {
+		matched = lines
+	}
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	return strings.TrimSpace(strings.Join(matched, "\n"))
+}
+
+// CoprBuildURL is the web page showing a COPR build's status
+func coprBuildURL(buildID string) string {
+	return fmt.Sprintf("https://copr.fedorainfracloud.org/coprs/build/%s/", buildID)
+}
+
+// CoprBuild is a build as listed by copr-cli list-builds
+type CoprBuild struct {
+	ID            int64  `json:"id"`
+	State         string `json:"state"`
+	SourcePackage struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"source_package"`
+}
+
+// PruneCoprBuilds deletes the builds of pkg in project older than the keep
+// most recent ones. Builds that are still in progress are never deleted.
+func pruneCoprBuilds(project, pkg string, keep int) error {
+	stdout, stderr, err := coprCLI("list-builds", project, "--output-format", "json")
+	if err != nil {
+		return fmt.Errorf("error listing COPR builds: %v\nStderr: %s", err, stderr)
+	}
+
+	var builds []CoprBuild
+	if err := json.Unmarshal([]byte(stdout), &builds); err != nil {
+		return fmt.Errorf("error parsing COPR build list: %v", err)
+	}
+
+	toDelete := selectBuildsToPrune(builds, pkg, keep)
+	if len(toDelete) == 0 {
+		out.Println("No COPR builds to prune")
+		return nil
+	}
+
+	args := []string{"delete-build"}
+	for _, build := range toDelete {
+		out.Printf("Deleting COPR build %d (%s %s, %s)\n", build.ID, build.SourcePackage.Name, build.SourcePackage.Version, build.State)
+		args = append(args, strconv.FormatInt(build.ID, 10))
+	}
+	if _, stderr, err := coprCLI(args...); err != nil {
+		return fmt.Errorf("error deleting COPR builds: %v\nStderr: %s", err, stderr)
+	}
+	out.Printf("Deleted %d COPR builds\n", len(toDelete))
+	return nil
+}
+
+// SelectBuildsToPrune returns the finished builds of pkg beyond the keep
+// most recent ones, newest first. Build IDs increase over time.
+func selectBuildsToPrune(builds []CoprBuild, pkg string, keep int) []CoprBuild {
+	var pkgBuilds []CoprBuild
+	for _, build := range builds {
+		if build.SourcePackage.Name == pkg {
+			pkgBuilds = append(pkgBuilds, build)
+		}
+	}
+	sort.Slice(pkgBuilds, func(i, j int) bool { return pkgBuilds[i].ID > pkgBuilds[j].ID })
+
+	var toDelete []CoprBuild
+	for i, build := range pkgBuilds {
+		if i < keep {
+			continue
+		}
+		switch build.State {
+		case "succeeded", "failed", "canceled", "skipped":
+			toDelete = append(toDelete, build)
+		}
+	}
+	return toDelete
+}
+
+// CheckCoprProject confirms we are authenticated to COPR and the project
+// exists, so a submit does not fail cryptically at the end of a run
+func checkCoprProject(project string) error {
+	owner, name, ok := strings.Cut(project, "/")
+	if !ok {
+		return fmt.Errorf("invalid COPR project %q, expected owner/project", project)
+	}
+
+	user, err := checkCoprAuth()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"ownername": {owner}, "projectname": {name}}
+	resp, err := httpClient.Get(coprAPIURL + "/project?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("error accessing COPR API: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return fmt.Errorf("COPR project %s does not exist", project)
+	default:
+		return fmt.Errorf("error accessing COPR API: %d", resp.StatusCode)
+	}
+
+	// Other users can be granted builder rights, so a foreign owner is only
+	// worth a warning
+	if owner != user && !strings.HasPrefix(owner, "@") {
+		out.Printf("Warning: COPR user %s does not own %s, submitting needs builder permission\n", user, project)
+	}
+	return nil
+}
+
+// CheckCoprReachable makes a quick request to the COPR API to confirm the
+// frontend is up. Any answer below 500 counts as reachable.
+func checkCoprReachable() error {
+	client := &http.Client{Transport: httpClient.Transport, Timeout: 10 * time.Second}
+	start := time.Now()
+	resp, err := client.Get(coprAPIURL + "/")
+	if err != nil {
+		return fmt.Errorf("COPR unreachable: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("COPR unreachable: %s answered %d", coprAPIURL, resp.StatusCode)
+	}
+	out.Printf("COPR reachable (%d in %s)\n", resp.StatusCode, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// CheckCoprAuth confirms copr-cli has working credentials and returns the
+// COPR user name. A failure that looks transient is retried a few times; a
+// rejected login is reported straight away.
+func checkCoprAuth() (string, error) {
+	const attempts = 3
+	var stdout, stderr string
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		stdout, stderr, err = coprCLI("whoami")
+		if err == nil {
+			return strings.TrimSpace(stdout), nil
+		}
+		if coprLoginRejected(stderr) || attempt == attempts {
+			break
+		}
+		out.Printf("copr-cli whoami failed (attempt %d of %d), retrying...\n", attempt, attempts)
+		sleep(time.Duration(attempt) * 5 * time.Second)
+	}
+	return "", fmt.Errorf("%w (copr-cli whoami failed): %v\nStderr: %s\n"+
+		"Get a new API token from https://copr.fedorainfracloud.org/api/ and save it to ~/.config/copr", ErrCoprAuth, err, stderr)
+}
+
+// CoprLoginRejected reports whether copr-cli's error output says the
+// credentials themselves are bad, which retrying cannot fix
+func coprLoginRejected(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, marker := range []string{"expired", "invalid", "login", "no config file", "unauthorized"} {
+		if strings.Contains(stderr, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusReport compares the packaged version with upstream
+type StatusReport struct {
+	SpecVersion       string `json:"spec_version"`
+	LatestVersion     string `json:"latest_version"`
+	ReleasesBehind    int    `json:"releases_behind"`
+	BehindAtLeast     bool   `json:"behind_at_least,omitempty"`
+	Ahead             bool   `json:"ahead,omitempty"`
+	SpecPublishedAt   string `json:"spec_published_at,omitempty"`
+	LatestPublishedAt string `json:"latest_published_at,omitempty"`
+	GapDays           *int   `json:"gap_days,omitempty"`
+}
+
+// RunStatus reports how far the spec is behind the latest stable release.
+// It only reads the spec and the GitHub API.
+func runStatus(opts *Options) error {
+	rpmbuildPath, err := getRpmbuildPath()
+	if err != nil {
+		return err
+	}
+	specVersionValue, err := specVersion(filepath.Join(rpmbuildPath, "SPECS", "zen-browser.spec"))
+	if err != nil {
+		return err
+	}
+
+	// Page through the releases until the spec's version turns up
+	var releases []GitHubRelease
+	found := false
+	for page := 1; page <= githubMaxPages && !found; page++ {
+		list, err := fetchReleaseList(page, opts.GitHubToken)
+		if err != nil {
+			return err
+		}
+		releases = append(releases, list...)
+		for _, release := range list {
+			found = found || rpmVersion(release.TagName, opts.VersionPrefix) == specVersionValue
+		}
+		if len(list) < 100 {
+			break
+		}
+	}
+
+	report := buildStatusReport(specVersionValue, releases, opts.VersionPrefix)
+	if report.LatestVersion == "" {
+		return fmt.Errorf("no stable releases found")
+	}
+
+	if opts.Output == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding status: %v", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	out.Printf("Spec version:   %s\n", report.SpecVersion)
+	out.Printf("Latest version: %s\n", report.LatestVersion)
+	switch {
+	case report.Ahead:
+		out.Println("Status:         ahead of the latest upstream release")
+	case report.ReleasesBehind == 0:
+		out.Println("Status:         up to date")
+	case report.BehindAtLeast:
+		out.Printf("Status:         more than %d releases behind\n", report.ReleasesBehind)
+	default:
+		out.Printf("Status:         %d releases behind\n", report.ReleasesBehind)
+	}
+	switch {
+	case report.GapDays != nil:
+		out.Printf("Age gap:        %d days\n", *report.GapDays)
+	case !report.Ahead && !report.BehindAtLeast:
+		out.Println("Age gap:        unknown")
+	}
+	return nil
+}
+
+// BuildStatusReport counts the stable releases newer than specVersion in a
+// release list ordered newest first. A spec version missing from the list is
+// either ahead of upstream or older than the whole list.
+func buildStatusReport(specVersion string, releases []GitHubRelease, versionPrefix string) StatusReport {
+	report := StatusReport{SpecVersion: specVersion}
+	var stable []GitHubRelease
+	for _, release := range releases {
+		if !strings.Contains(release.TagName, "t") {
+			stable = append(stable, release)
+		}
+	}
+	if len(stable) == 0 {
+		return report
+	}
+	report.LatestVersion = rpmVersion(stable[0].TagName, versionPrefix)
+	report.LatestPublishedAt = stable[0].PublishedAt
+
+	found := false
+	for i, release := range stable {
+		if rpmVersion(release.TagName, versionPrefix) == specVersion {
+			report.ReleasesBehind = i
+			report.SpecPublishedAt = release.PublishedAt
+			found = true
+			break
+		}
+	}
+	if !found {
+		if compareVersions(specVersion, report.LatestVersion) > 0 {
+			report.Ahead = true
+		} else {
+			report.ReleasesBehind = len(stable)
+			report.BehindAtLeast = true
+		}
+		return report
+	}
+
+	specTime, ok1 := parsePublishedAt(report.SpecPublishedAt)
+	latestTime, ok2 := parsePublishedAt(report.LatestPublishedAt)
+	if ok1 && ok2 {
+		days := int(latestTime.Sub(specTime).Hours() / 24)
+		report.GapDays = &days
+	}
+	return report
+}
+
+// CompareVersions orders two RPM versions like rpmvercmp: they are compared
+// segment by segment, numbers numerically and ahead of letters, and a "~"
+// sorts before anything, even the end of the version. It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	isAlnum := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	for {
+		// Skip separators, but not the tilde which has its own meaning
+		for len(a) > 0 && !isAlnum(a[0]) && a[0] != '~' {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isAlnum(b[0]) && b[0] != '~' {
+			b = b[1:]
+		}
+
+		aTilde, bTilde := strings.HasPrefix(a, "~"), strings.HasPrefix(b, "~")
+		switch {
+		case aTilde && bTilde:
+			a, b = a[1:], b[1:]
+			continue
+		case aTilde:
+			return -1
+		case bTilde:
+			return 1
+		}
+		if a == "" || b == "" {
+			break
+		}
+
+		numeric := a[0] >= '0' && a[0] <= '9'
+		segmentEnd := func(s string) int {
+			i := 0
+			for i < len(s) && isAlnum(s[i]) && (s[i] >= '0' && s[i] <= '9') == numeric {
+				i++
+			}
+			return i
+		}
+		i, j := segmentEnd(a), segmentEnd(b)
+		segA, segB := a[:i], b[:j]
+		a, b = a[i:], b[j:]
+
+		// A number is newer than letters in the same position
+		if segB == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		if numeric {
+			segA, segB = strings.TrimLeft(segA, "0"), strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// OSReleasePath is the os-release file describing the host distribution
+var osReleasePath = "/etc/os-release"
+
+// RpmDistributions are os-release IDs of RPM-based distributions
+var rpmDistributions = []string{"fedora", "rhel", "centos", "rocky", "almalinux", "suse", "opensuse", "mageia", "amzn", "ol"}
+
+// RpmHostWarning explains why the host cannot build SRPMs, or returns "" when
+// rpmbuild is installed. It names the distribution from os-release so running
+// on Debian or Ubuntu is reported as such rather than as a missing command.
+func rpmHostWarning() string {
+	if _, err := exec.LookPath("rpmbuild"); err == nil {
+		return ""
+	}
+
+	fields := map[string]string{}
+	if content, err := os.ReadFile(osReleasePath); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+				fields[key] = strings.Trim(value, `"'`)
+			}
+		}
+	}
+	name := fields["PRETTY_NAME"]
+	if name == "" {
+		name = fields["ID"]
+	}
+
+	for _, id := range strings.Fields(fields["ID"] + " " + fields["ID_LIKE"]) {
+		for _, rpmID := range rpmDistributions {
+			if id == rpmID {
+				return "rpmbuild is not installed, install rpm-build to build the SRPM"
+			}
+		}
+	}
+	if name == "" {
+		return "rpmbuild is not installed and this host does not look RPM-based; building and submitting need an RPM-based distribution such as Fedora"
+	}
+	return fmt.Sprintf("this host runs %s, not an RPM-based distribution, and rpmbuild is not installed; building and submitting need an RPM-based distribution such as Fedora", name)
+}
+
+// RunDoctor checks that the environment can build and submit packages
+func runDoctor(opts *Options) error {
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			out.Printf("FAIL %s: %v\n", name, err)
+			failed++
+			return
+		}
+		out.Printf("OK   %s\n", name)
+	}
+
+	for _, tool := range []string{"rpmbuild", "copr-cli"} {
+		_, err := exec.LookPath(tool)
+		if err != nil && tool == "rpmbuild" {
+			err = errors.New(rpmHostWarning())
+		}
+		check(tool+" installed", err)
+	}
+
+	rpmbuildPath, err := getRpmbuildPath()
+	if err == nil {
+		rpmbuildPath, err = prepareRpmbuildTree(rpmbuildPath)
+	}
+	check("rpmbuild tree", err)
+	if err == nil {
+		_, err = specVersion(filepath.Join(rpmbuildPath, "SPECS", "zen-browser.spec"))
+		check("spec file", err)
+	}
+
+	// Check the project each arch would submit to for a stable release
+	arches, err := archList(opts.Arch)
+	check("architecture", err)
+	checked := make(map[string]bool)
+	for _, arch := range arches {
+		project, err := resolveCoprProject(opts.CoprProject, "stable", arch)
+		if err != nil {
+			check("COPR project", err)
+			continue
+		}
+		if checked[project] {
+			continue
+		}
+		checked[project] = true
+		check("COPR project "+project, checkCoprProject(project))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d doctor checks failed", failed)
+	}
+	return nil
+}
+
+func main() {
+	opts, err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+
+	out.quiet = opts.QuietUpToDate
+	out.debug = opts.Debug
+	out.explain = opts.Explain
+	traceCommands = opts.TraceCommands
+	out.color = colorEnabled(opts.Color, os.Stdout)
+	if opts.LogFile != "" {
+		logFile, err := os.OpenFile(opts.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			out.flush()
+			out.Printf("Error opening log file: %v\n", err)
+			os.Exit(exitError)
+		}
+		defer logFile.Close()
+		out.file = logFile
+	}
+	versionTransforms = opts.VersionTransforms
+	redactor.enabled = opts.RedactSecrets
+	redactor.addFromEnv()
+	if err := loadCredentials(opts); err != nil {
+		out.flush()
+		out.Println(err)
+		os.Exit(exitUsage)
+	}
+	if err := configureHTTP(opts); err != nil {
+		out.flush()
+		out.Println(err)
+		os.Exit(exitError)
+	}
+
+	// Stop cleanly on SIGINT/SIGTERM, abandoning any download in progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch {
+	case opts.Command == "doctor":
+		err = runDoctor(opts)
+	case opts.Command == "status":
+		err = runStatus(opts)
+	case opts.Command == "assets":
+		err = runAssets(opts.Tag, opts.GitHubToken)
+	case opts.Command == "list-assets":
+		err = runListAssets(opts)
+	case opts.Interval > 0:
+		err = runDaemon(ctx, opts)
+	default:
+		_, err = runAndReport(ctx, opts)
+	}
+	if code := exitCode(err); code != exitOK {
+		out.flush()
+		out.Println(err)
+		os.Exit(code)
+	}
+}
+
+// AssetInfo describes a release asset for the assets subcommand
+type AssetInfo struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	DownloadURL string `json:"download_url"`
+}
+
+// RunAssets prints the assets of the release tagged tag as JSON, with the
+// content type and size reported by a HEAD request for each. It changes
+// nothing.
+func runAssets(tag, token string) error {
+	release, err := fetchReleaseByTag(tag, token)
+	if err != nil {
+		return err
+	}
+	if len(release.Assets) == 0 {
+		return fmt.Errorf("release %s has no assets", tag)
+	}
+
+	assets := make([]AssetInfo, 0, len(release.Assets))
+	for _, asset := range release.Assets {
+		info := AssetInfo{Name: asset.Name, Size: asset.Size, DownloadURL: asset.DownloadURL}
+		size, contentType, err := assetMetadata(asset.DownloadURL)
+		if err != nil {
+			// Stdout holds the JSON, so warnings go to stderr
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", redactor.redact(err.Error()))
+		} else {
+			info.ContentType = contentType
+			if size >= 0 {
+				info.Size = size
+			}
+		}
+		assets = append(assets, info)
+	}
+
+	data, err := json.MarshalIndent(assets, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding assets: %v", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// RunListAssets prints the assets of the latest release, or of opts.Tag, as a
+// table for seeing why an asset was not matched. It changes nothing.
+func runListAssets(opts *Options) error {
+	arches, err := archList(opts.Arch)
+	if err != nil {
+		return err
+	}
+
+	var release *GitHubRelease
+	if opts.Tag != "" {
+		release, err = fetchReleaseByTag(opts.Tag, opts.GitHubToken)
+	} else {
+		release, err = fetchLatestRelease(nil, opts.GitHubToken, opts.RateLimitWait)
+	}
+	if err != nil {
+		return err
+	}
+	return writeAssetTable(os.Stdout, release, arches)
+}
+
+// WriteAssetTable writes a release's assets as a table of name, size and
+// URL, marking the tarball each of arches would use
+func writeAssetTable(w io.Writer, release *GitHubRelease, arches []string) error {
+	fmt.Fprintf(w, "Release %s, %d assets\n\n", release.TagName, len(release.Assets))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tMATCH\tURL")
+	for _, asset := range release.Assets {
+		match := "-"
+		for _, arch := range arches {
+			if asset.Name == fmt.Sprintf("zen.linux-%s.tar.xz", arch) {
+				match = arch
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", asset.Name, asset.Size, match, asset.DownloadURL)
+	}
+	return tw.Flush()
+}
+
+// FetchReleaseByTag fetches the release with the given tag from the GitHub
+// API, authenticating with the token when there is one
+func fetchReleaseByTag(tag, token string) (*GitHubRelease, error) {
+	req, err := http.NewRequest(http.MethodGet, githubTagURL+url.PathEscape(tag), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing GitHub API: %v", err)
+	}
+	setGitHubHeaders(req, token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing GitHub API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("release %s not found", tag)
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if limitErr := rateLimitError(resp, body); limitErr != nil {
+			return nil, limitErr
+		}
+		return nil, fmt.Errorf("error accessing GitHub API: %d", resp.StatusCode)
+	}
+
+	body, err := readAPIResponse(resp.Body, maxAPIResponseSize)
+	if err != nil {
+		return nil, err
+	}
+	var release GitHubRelease
+	if err := json.Unmarshal(body, &release); err != nil {
+		return nil, fmt.Errorf("error parsing GitHub API response: %v", err)
+	}
+	return &release, nil
+}
+
+// AssetMetadata sends a HEAD request for an asset, with a 10 second timeout,
+// and returns its size (-1 if not reported) and content type
+func assetMetadata(downloadURL string) (int64, string, error) {
+	client := &http.Client{Transport: httpClient.Transport, Timeout: 10 * time.Second}
+	resp, err := client.Head(downloadURL)
+	if err != nil {
+		return -1, "", fmt.Errorf("error checking %s: %w", downloadURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1, "", fmt.Errorf("error checking %s: %s", downloadURL, resp.Status)
+	}
+	return resp.ContentLength, resp.Header.Get("Content-Type"), nil
+}
+
+// LoadCredentials resolves the credentials given as files, as mounted from
+// Docker or Kubernetes secrets, which keeps them out of the environment. The
+// GitHub token from --github-token-file takes precedence over GITHUB_TOKEN;
+// --copr-token-file is the copr-cli configuration holding the COPR token.
+func loadCredentials(opts *Options) error {
+	opts.GitHubToken = os.Getenv("GITHUB_TOKEN")
+	if opts.GitHubTokenFile != "" {
+		token, err := readSecretFile(opts.GitHubTokenFile)
+		if err != nil {
+			return err
+		}
+		redactor.add(token)
+		opts.GitHubToken = token
+	}
+
+	if opts.CoprTokenFile != "" {
+		if _, err := os.Stat(opts.CoprTokenFile); err != nil {
+			return fmt.Errorf("error reading COPR token file: %v", err)
+		}
+	}
+	coprConfig = opts.CoprTokenFile
+
+	// An app installation token is preferred over a personal one
+	githubApp = nil
+	if opts.GitHubAppID != "" {
+		keyPEM, err := os.ReadFile(opts.GitHubAppKeyFile)
+		if err != nil {
+			return fmt.Errorf("error reading GitHub App key: %v", err)
+		}
+		if githubApp, err = newGitHubApp(opts.GitHubAppID, opts.InstallationID, keyPEM); err != nil {
+			return err
+		}
+		opts.GitHubToken = ""
+	}
+	return nil
+}
+
+// GitHubAppTokenURL is where an app's JWT is exchanged for an installation
+// access token
+const githubAppTokenURL = "https://api.github.com/app/installations/%s/access_tokens"
+
+// GitHubApp authenticates as an installation of a GitHub App, set up with
+// --github-app-id. Its installation token is cached and replaced shortly
+// before it expires.
+type GitHubApp struct {
+	AppID          string
+	InstallationID string
+	Key            *rsa.PrivateKey
+	TokenURL       string
+
+	mu      sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+// GithubApp is the app authenticating GitHub API requests without a token of
+// their own, or nil
+var githubApp *GitHubApp
+
+// NewGitHubApp sets up authentication as an app installation with the app's
+// private key in PEM form, PKCS #1 as GitHub issues it or PKCS #8
+func newGitHubApp(appID, installationID string, keyPEM []byte) (*GitHubApp, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("GitHub App key is not in PEM format")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if err8 != nil || !ok {
+			return nil, fmt.Errorf("GitHub App key is not an RSA private key: %v", err)
+		}
+		key = rsaKey
+	}
+	return &GitHubApp{
+		AppID:          appID,
+		InstallationID: installationID,
+		Key:            key,
+		TokenURL:       fmt.Sprintf(githubAppTokenURL, url.PathEscape(installationID)),
+	}, nil
+}
+
+// JWT signs the short-lived RS256 token that identifies the app itself.
+// It is backdated a minute to allow for clock drift, and GitHub accepts at
+// most ten minutes of validity.
+func (a *GitHubApp) jwt(now time.Time) (string, error) {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	header := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims := encode(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.AppID,
+	})
+	signed := header + "." + claims
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("error signing GitHub App JWT: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Token returns an installation access token, exchanging a new JWT for one
+// when there is none yet or it expires within five minutes
+func (a *GitHubApp) token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cached != "" && time.Until(a.expires) > 5*time.Minute {
+		return a.cached, nil
+	}
+
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.TokenURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error requesting GitHub App installation token: %v", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting GitHub App installation token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return "", fmt.Errorf("error requesting GitHub App installation token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Token == "" {
+		return "", fmt.Errorf("error parsing GitHub App installation token: %v", err)
+	}
+	redactor.add(result.Token)
+	a.cached = result.Token
+	a.expires = result.ExpiresAt
+	out.Debugf("GitHub App installation token valid until %s\n", result.ExpiresAt.Format(time.RFC3339))
+	return a.cached, nil
+}
+
+// ReadSecretFile reads a secret from a file, without trailing newlines
+func readSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %v", err)
+	}
+	secret := strings.TrimRight(string(content), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// ConfigureHTTP sets up the shared HTTP client from the options
+func configureHTTP(opts *Options) error {
+	if opts.RecordHTTP != "" && opts.ReplayHTTP != "" {
+		return fmt.Errorf("--record-http and --replay-http cannot be used together")
+	}
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if base, ok := transport.(*http.Transport); ok && opts.PreferIPv4 {
+		base = base.Clone()
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		base.DialContext = preferIPv4Dial(dialer.DialContext)
+		transport = base
+	}
+	if opts.RecordHTTP != "" {
+		if err := os.MkdirAll(opts.RecordHTTP, 0755); err != nil {
+			return fmt.Errorf("error creating HTTP recording directory: %v", err)
+		}
+		transport = &recordingTransport{dir: opts.RecordHTTP, base: transport}
+	}
+	if opts.ReplayHTTP != "" {
+		transport = &replayTransport{dir: opts.ReplayHTTP}
+	}
+	httpClient.Transport = transport
+	return nil
+}
+
+// DialFunc opens a network connection, like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// PreferIPv4Dial wraps dial so TCP connections go over IPv4, working around
+// broken IPv6 routes. Only when IPv4 fails, such as for a host without an
+// IPv4 address, is any address family tried.
+func preferIPv4Dial(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return dial(ctx, network, addr)
+		}
+		conn, err := dial(ctx, "tcp4", addr)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		out.Debugf("IPv4 connection to %s failed, trying any address: %v\n", addr, err)
+		return dial(ctx, network, addr)
+	}
+}
+
+// HTTPRecording is the metadata of a recorded HTTP exchange. The response
+// body is stored next to it in a .body file.
+type HTTPRecording struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"request_header"`
+	StatusCode    int         `json:"status_code"`
+	Header        http.Header `json:"header"`
+}
+
+// RecordingName is the file name, without extension, of the recording of a
+// request. Recordings are keyed by method and URL.
+func recordingName(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	return req.Method + "-" + hex.EncodeToString(sum[:8])
+}
+
+// RecordingTransport saves every exchange made through it to a directory
+type recordingTransport struct {
+	dir  string
+	base http.RoundTripper
+}
+
+// RoundTrip performs the request and records it, streaming the response
+// body to disk as the caller reads it
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	requestHeader := req.Header.Clone()
+	if requestHeader.Get("Authorization") != "" {
+		requestHeader.Set("Authorization", "REDACTED")
+	}
+	recording := HTTPRecording{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: requestHeader,
+		StatusCode:    resp.StatusCode,
+		Header:        resp.Header,
+	}
+	name := filepath.Join(t.dir, recordingName(req))
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err == nil {
+		err = os.WriteFile(name+".json", append(data, '\n'), 0644)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error recording HTTP response: %v", err)
+	}
+
+	file, err := os.Create(name + ".body")
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error recording HTTP response: %v", err)
+	}
+	resp.Body = &recordingBody{Reader: io.TeeReader(resp.Body, file), body: resp.Body, file: file}
+	return resp, nil
+}
+
+// RecordingBody copies a response body to a file as it is read
+type recordingBody struct {
+	io.Reader
+	body io.ReadCloser
+	file *os.File
+}
+
+// Close closes both the response body and the recording file
+func (b *recordingBody) Close() error {
+	b.file.Close()
+	return b.body.Close()
+}
+
+// ReplayTransport answers requests from recordings instead of the network
+type replayTransport struct {
+	dir string
+}
+
+// RoundTrip returns the recorded response for the request
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name := filepath.Join(t.dir, recordingName(req))
+	data, err := os.ReadFile(name + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("no HTTP recording for %s %s", req.Method, req.URL)
+	}
+	var recording HTTPRecording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		return nil, fmt.Errorf("error parsing HTTP recording %s: %v", name+".json", err)
+	}
+
+	body, err := os.Open(name + ".body")
+	if err != nil {
+		return nil, fmt.Errorf("error opening HTTP recording body: %v", err)
+	}
+	info, err := body.Stat()
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("error opening HTTP recording body: %v", err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recording.StatusCode, http.StatusText(recording.StatusCode)),
+		StatusCode:    recording.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recording.Header,
+		Body:          body,
+		ContentLength: info.Size(),
+		Request:       req,
+	}, nil
+}
+
+// RunDaemon repeats the update check every opts.Interval, varied by
+// opts.IntervalJitter, until the context is cancelled or opts.MaxCycles
+// checks have run. A failed check is logged and retried at the next interval.
+func runDaemon(ctx context.Context, opts *Options) error {
+	for cycle := 1; ; cycle++ {
+		// Each cycle is quiet again until it finds something to report
+		out.quiet = opts.QuietUpToDate
+		out.held.Reset()
+
+		summary, err := runAndReport(ctx, opts)
+		var freezeErr *FreezeError
+		switch {
+		case ctx.Err() != nil:
+			out.flush()
+			out.Printf("Cycle %d interrupted, exiting\n", cycle)
+			return nil
+		case errors.As(err, &freezeErr):
+			out.Printf("Cycle %d: %v\n", cycle, err)
+		case err != nil && !nothingToDo(err):
+			out.flush()
+			out.Printf("Cycle %d failed: %v\n", cycle, err)
+		case summary.Updated:
+			out.Printf("Cycle %d updated to %s\n", cycle, summary.LatestVersion)
+			// The spec is now bootstrapped, so later cycles compare as usual
+			opts.AssumeVersion = ""
+		default:
+			out.Printf("Cycle %d: nothing to do\n", cycle)
+		}
+
+		if opts.MaxCycles > 0 && cycle >= opts.MaxCycles {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			out.flush()
+			out.Println("Terminated, exiting")
+			return nil
+		case <-time.After(jitteredInterval(opts.Interval, opts.IntervalJitter, mathrand.Float64())):
+		}
+	}
+}
+
+// JitteredInterval varies interval by up to percent either way, so instances
+// started together spread out their GitHub requests. r is a random number in
+// [0, 1); 0.5 gives the interval unchanged.
+func jitteredInterval(interval time.Duration, percent, r float64) time.Duration {
+	offset := float64(interval) * percent / 100 * (2*r - 1)
+	return interval + time.Duration(offset)
+}
+
+// AcquireLock takes an exclusive lock on path so only one run works on the
+// rpmbuild tree at a time. The lock is released by the returned function or
+// when the process exits.
+func acquireLock(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("another run holds the lock %s (use --no-lock to skip)", path)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// RunAndReport runs the update and writes the summary however the run ends,
+// including on a panic, so the summary file is always valid JSON
+func runAndReport(ctx context.Context, opts *Options) (summary *RunSummary, err error) {
+	summary = &RunSummary{Arch: opts.Arch}
+	started := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		summary.endPhase()
+		if err != nil && !nothingToDo(err) {
+			summary.Error = redactor.redact(err.Error())
+		}
+		if werr := writeSummary(opts, summary); werr != nil && err == nil {
+			err = werr
+		}
+		if werr := writeReport(opts, summary); werr != nil && err == nil {
+			err = werr
+		}
+		if werr := writeGitHubOutput(summary); werr != nil && err == nil {
+			err = werr
+		}
+		if opts.OutputDir != "" {
+			collectArtifacts(opts.OutputDir, summary)
+		}
+		if opts.HistoryDB != "" {
+			recordHistory(opts.HistoryDB, summary, started, err)
+		}
+	}()
+
+	return summary, run(ctx, opts, summary)
+}
+
+// HistorySchema creates the table of runs in a --history-db database
+const historySchema = `CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at TEXT NOT NULL,
+	finished_at TEXT NOT NULL,
+	arch TEXT,
+	current_version TEXT,
+	latest_version TEXT,
+	published_at TEXT,
+	outcome TEXT NOT NULL,
+	error TEXT,
+	build_id TEXT,
+	staging_build_id TEXT,
+	srpm_sha256 TEXT,
+	source_sha256 TEXT
+);`
+
+// HistoryInsert adds a run to a --history-db database. Its values are read
+// from the JSON file named by the :run parameter rather than quoted into the
+// SQL, with null as NULL.
+const historyInsert = `INSERT INTO runs (started_at, finished_at, arch, current_version, latest_version,
+	published_at, outcome, error, build_id, staging_build_id, srpm_sha256, source_sha256)
+SELECT json_extract(run, '$.started_at'), json_extract(run, '$.finished_at'), json_extract(run, '$.arch'),
+	json_extract(run, '$.current_version'), json_extract(run, '$.latest_version'),
+	json_extract(run, '$.published_at'), json_extract(run, '$.outcome'), json_extract(run, '$.error'),
+	json_extract(run, '$.build_id'), json_extract(run, '$.staging_build_id'),
+	json_extract(run, '$.srpm_sha256'), json_extract(run, '$.source_sha256')
+FROM (SELECT CAST(readfile(:run) AS TEXT) AS run);`
+
+// RecordHistory adds a row for the run to the SQLite database at path,
+// creating the table on first use. The sqlite3 command does the writing, so
+// the tool keeps to the standard library, and the values reach it as a JSON
+// file bound to a parameter. It is best effort and only warns on failures.
+func recordHistory(path string, summary *RunSummary, started time.Time, runErr error) {
+	var freezeErr *FreezeError
+	outcome := "up to date"
+	switch {
+	case errors.As(runErr, &freezeErr):
+		outcome = "frozen"
+	case runErr != nil && !nothingToDo(runErr):
+		outcome = "failed"
+	case summary.Updated:
+		outcome = "updated"
+	}
+
+	var sources string
+	if len(summary.SourceSHA256) > 0 {
+		data, _ := json.Marshal(summary.SourceSHA256)
+		sources = string(data)
+	}
+
+	values := map[string]string{
+		"started_at":       started.UTC().Format(time.RFC3339),
+		"finished_at":      time.Now().UTC().Format(time.RFC3339),
+		"arch":             summary.Arch,
+		"current_version":  summary.CurrentVersion,
+		"latest_version":   summary.LatestVersion,
+		"published_at":     summary.PublishedAt,
+		"outcome":          outcome,
+		"error":            summary.Error,
+		"build_id":         summary.BuildID,
+		"staging_build_id": summary.StagingBuildID,
+		"srpm_sha256":      summary.SRPMSHA256,
+		"source_sha256":    sources,
+	}
+	row := map[string]any{}
+	for key, value := range values {
+		row[key] = nil
+		if value != "" {
+			row[key] = value
+		}
+	}
+
+	if err := insertHistory(path, row); err != nil {
+		out.Printf("Warning: could not record the run in %s: %v\n", path, err)
+	}
+}
+
+// InsertHistory writes row to a temporary JSON file and has sqlite3 insert it
+// with historyInsert
+func insertHistory(path string, row map[string]any) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp("", "zen-history-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// Dot commands split their arguments on spaces
+	if !shellSafeRegex.MatchString(file.Name()) {
+		return fmt.Errorf("unusable temporary file name %q", file.Name())
+	}
+
+	_, stderr, err := runCommand("sqlite3", "-bail", "-cmd", ".parameter set :run "+file.Name(), path, historySchema+"\n"+historyInsert)
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// CollectArtifacts copies the outputs of the run into a new timestamped
+// directory under outputDir. It is best effort and only warns on failures.
+func collectArtifacts(outputDir string, summary *RunSummary) {
+	runDir := filepath.Join(outputDir, time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		out.Printf("Warning: could not create output directory: %v\n", err)
+		return
+	}
+
+	for _, path := range []string{summary.SpecFile, strings.TrimPrefix(summary.SRPMPath, "Wrote: "), summary.BuildLog} {
+		// The build log is already written to outputDir
+		if path == "" || filepath.Dir(path) == filepath.Clean(outputDir) {
+			continue
+		}
+		if err := copyFile(path, filepath.Join(runDir, filepath.Base(path))); err != nil {
+			out.Printf("Warning: could not copy %s to output directory: %v\n", path, err)
+		}
+	}
+
+	if data, err := json.MarshalIndent(summary, "", "  "); err != nil {
+		out.Printf("Warning: could not encode summary for output directory: %v\n", err)
+	} else if err := os.WriteFile(filepath.Join(runDir, "summary.json"), append(data, '\n'), 0644); err != nil {
+		out.Printf("Warning: could not write summary to output directory: %v\n", err)
+	}
+
+	if summary.SpecDiff != "" {
+		if err := os.WriteFile(filepath.Join(runDir, "spec.diff"), []byte(summary.SpecDiff), 0644); err != nil {
+			out.Printf("Warning: could not write spec diff to output directory: %v\n", err)
+		}
+	}
+
+	out.Printf("Run artifacts collected in %s\n", runDir)
+}
+
+// CopyFile copies the file at src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, in); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// DiffSpec returns a unified diff from the original spec content to the
+// spec file as it is now, or an empty string if diff is unavailable. The
+// original is written to a temporary file in workDir, or the system
+// temporary directory when it is "".
+func diffSpec(original []byte, specFilePath, workDir string) string {
+	oldFile, err := os.CreateTemp(workDir, "zen-browser-spec-*")
+	if err != nil {
+		return ""
+	}
+	defer os.Remove(oldFile.Name())
+	_, err = oldFile.Write(original)
+	oldFile.Close()
+	if err != nil {
+		return ""
+	}
+
+	name := filepath.Base(specFilePath)
+	cmd := exec.Command("diff", "-u", "--label", "a/"+name, "--label", "b/"+name, oldFile.Name(), specFilePath)
+	traceCommand(cmd)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	// diff exits with 1 when the files differ
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			return ""
+		}
+	}
+	return stdout.String()
+}
+
+// RunConfig is the state of one run derived from its options, set up by run
+// and passed to each target. Settings fixed for the whole process at startup,
+// such as credentials and --version-transform, stay in package variables
+// because commands other than a run use them too.
+type RunConfig struct {
+	// WorkDir is the run's own temporary directory, removed when it ends
+	// unless it failed with --keep-temp. Tarballs are downloaded and SRPMs
+	// built there before being moved into the shared rpmbuild tree, and spec
+	// diffs and extraction checks use it too; "" works in that tree and the
+	// system temporary directory directly.
+	WorkDir string
+	// Downloader fetches source tarballs, selected with --downloader
+	Downloader Downloader
+	// ChecksumRetries is how many times a tarball whose checksum does not
+	// match is downloaded again before giving up
+	ChecksumRetries int
+	// RpmbuildRetries is how many times rpmbuild is run again after a
+	// failure matching one of TransientPatterns
+	RpmbuildRetries   int
+	TransientPatterns []*regexp.Regexp
+	Changelog         ChangelogConfig
+	// ProjectChroots caches each COPR project's enabled chroots
+	ProjectChroots map[string][]string
+	// OutputDir is --output-dir, where build logs are saved; without it they
+	// go to WorkDir
+	OutputDir string
+
+	authOnce sync.Once
+	authErr  error
+	// targetMu is held by processTarget for everything but downloads, so
+	// that builds, submissions and updates to the state and summary happen
+	// one target at a time while tarballs download in parallel
+	targetMu sync.Mutex
+}
+
+// NewRunConfig sets up a run's state from the options, without its work
+// directory
+func newRunConfig(opts *Options) (*RunConfig, error) {
+	downloader, err := newDownloader(opts.Downloader, opts.PreferIPv4)
+	if err != nil {
+		return nil, err
+	}
+	changelog, err := newChangelogConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &RunConfig{
+		Downloader:        downloader,
+		ChecksumRetries:   opts.ChecksumRetries,
+		RpmbuildRetries:   opts.RpmbuildRetries,
+		TransientPatterns: append(append([]*regexp.Regexp{}, defaultTransientBuildPatterns...), opts.TransientPatterns...),
+		Changelog:         changelog,
+		ProjectChroots:    map[string][]string{},
+		OutputDir:         opts.OutputDir,
+	}, nil
+}
+
+// CheckCoprAuth checks COPR credentials the first time a target of the run
+// needs them and returns the same result to the others
+func (cfg *RunConfig) checkCoprAuth() error {
+	cfg.authOnce.Do(func() { _, cfg.authErr = checkCoprAuth() })
+	return cfg.authErr
+}
+
+// Run checks for a new release and, if there is one, builds and submits it
+func run(ctx context.Context, opts *Options, summary *RunSummary) (err error) {
+	out.Println("Checking for new Zen Browser releases...")
+
+	// Set paths based on environment
+	rpmbuildPath, err := getRpmbuildPath()
+	if err != nil {
+		return err
+	}
+	// Checking downloads creates nothing, so the tree is only checked and
+	// no lock file is taken
+	if opts.CheckDownload {
+		if err := checkRpmBuildRoot(rpmbuildPath); err != nil {
+			return fmt.Errorf("invalid rpmbuild tree: %v", err)
+		}
+	} else if rpmbuildPath, err = prepareRpmbuildTree(rpmbuildPath); err != nil {
+		return err
+	}
+	specsDir := filepath.Join(rpmbuildPath, "SPECS")
+	sourcesDir := filepath.Join(rpmbuildPath, "SOURCES")
+
+	if !opts.NoLock && !opts.CheckDownload {
+		unlock, err := acquireLock(filepath.Join(rpmbuildPath, lockFileName))
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	cfg, err := newRunConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	// Intermediate files go to a directory of their own, so runs with
+	// --no-lock never share them
+	if cfg.WorkDir, err = os.MkdirTemp("", "zen-browser-run-*"); err != nil {
+		return fmt.Errorf("error creating run directory: %v", err)
+	}
+	defer func() {
+		cfg.removeWorkDir(exitCode(err) != exitOK && opts.KeepTemp)
+	}()
+
+	statePath := stateFilePath(opts, rpmbuildPath)
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Catch a COPR outage before any work rather than at submit
+	if opts.ValidateReachable && !opts.CheckDownload && !opts.NoSubmit && !opts.Prefetch {
+		if err := checkCoprReachable(); err != nil {
+			return err
+		}
+	}
+
+	// Building needs rpm tooling, which a wrong OS only reveals at rpmbuild
+	if !opts.CheckDownload && !opts.Prefetch {
+		if warning := rpmHostWarning(); warning != "" {
+			out.Printf("Warning: %s\n", warning)
+		}
+	}
+
+	// Checking downloads must always see the release and must not write
+	// anything, so it bypasses the state entirely
+	if opts.CheckDownload {
+		state = nil
+	} else {
+		// The state is only saved after a successful run, so a failed build
+		// is retried next time instead of being hidden behind a 304
+		defer func() {
+			if err == nil || nothingToDo(err) {
+				if serr := saveState(statePath, state); serr != nil {
+					err = serr
+				}
+			}
+		}()
+	}
+
+	// An assumed version means the spec can't be trusted, so neither can a
+	// 304 saying nothing changed since it was last updated. A prefetch wants
+	// the tarball whether or not anything changed.
+	if (opts.AssumeVersion != "" || opts.Prefetch) && state != nil {
+		state.ETag = ""
+		state.LastModified = ""
+	}
+
+	// Get latest release info for every requested arch from one API call
+	summary.beginPhase("fetch release")
+	var releases []ReleaseInfo
+	if opts.SourceURL != "" {
+		releases, err = sourceURLRelease(opts)
+	} else {
+		releases, err = getLatestRelease(opts, state)
+	}
+	if errors.Is(err, ErrTwilightSkipped) {
+		releases, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Skip if we got nil due to an unchanged or twilight/nightly release,
+	// still reporting what is known for freshness dashboards
+	if releases == nil {
+		if state != nil {
+			summary.LatestVersion = state.LatestVersion
+			summary.PublishedAt = state.PublishedAt
+		}
+		if version, err := specVersion(filepath.Join(specsDir, "zen-browser.spec")); err == nil {
+			summary.CurrentVersion = version
+		}
+		return nil
+	}
+	summary.LatestVersion = releases[0].Version
+	summary.PublishedAt = releases[0].PublishedAt
+	summary.ReleaseNotes = releases[0].Notes
+
+	targets := groupBySpec(specsDir, releases)
+	if opts.CoprPreflight && !opts.CheckDownload && !opts.NoSubmit && !opts.Prefetch {
+		for _, target := range targets {
+			project, err := target.coprProject(opts.CoprProject)
+			if err != nil {
+				return err
+			}
+			if err := checkCoprProject(project); err != nil {
+				return err
+			}
+		}
+	}
+	// A --source-url build says nothing about the latest release
+	if state != nil && opts.SourceURL == "" {
+		state.LatestVersion = releases[0].Version
+		state.PublishedAt = releases[0].PublishedAt
+	}
+
+	// Only verify the downloads, without touching the spec or building
+	if opts.CheckDownload {
+		out.flush()
+		for _, release := range releases {
+			size, err := checkDownload(release.DownloadURL)
+			if err != nil {
+				return err
+			}
+			if size < 0 {
+				out.Printf("%s is reachable (size unknown)\n", release.Filename)
+			} else {
+				out.Printf("%s is reachable (%d bytes)\n", release.Filename, size)
+			}
+		}
+
+		// Let CI tell whether there is anything to build
+		for _, target := range targets {
+			current := opts.AssumeVersion
+			if current == "" {
+				if current, err = specVersion(target.SpecFile); err != nil {
+					return err
+				}
+			}
+			summary.CurrentVersion = current
+			if current != target.Releases[0].Version {
+				return fmt.Errorf("%w: %s (%s has %s)", ErrUpdateAvailable, target.Releases[0].Version, filepath.Base(target.SpecFile), current)
+			}
+		}
+		return nil
+	}
+
+	// Only stage the tarballs in SOURCES, whatever version the spec is at
+	if opts.Prefetch {
+		summary.beginPhase("download")
+		if opts.MinFreeSpace > 0 {
+			if err := checkFreeSpace(ctx, sourcesDir, opts.MinFreeSpace, releases); err != nil {
+				return err
+			}
+		}
+		for i := range releases {
+			release := &releases[i]
+			source, stats, err := fetchSource(ctx, cfg, opts, release, sourcesDir, state.Checksums[release.Arch], false)
+			if err != nil {
+				return err
+			}
+			recordChecksum(state, release.Arch, source)
+			summary.recordSourceChecksum(release.Arch, source.SHA256)
+			if opts.ReportDownloadSpeed {
+				summary.recordDownload(release.Arch, stats)
+			}
+		}
+		// The spec was not updated, so the next run must not be told by a
+		// 304 that there is nothing to do
+		state.ETag = ""
+		state.LastModified = ""
+		out.Println("Sources prefetched; spec not changed")
+		return nil
+	}
+
+	if err := processTargets(ctx, cfg, opts, targets, sourcesDir, state, summary); err != nil {
+		return err
+	}
+
+	if summary.Updated {
+		out.Println("Done!")
+	}
+	return nil
+}
+
+// SpecVersion reads the Version tag of a spec file
+func specVersion(specFilePath string) (string, error) {
+	specContent, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return "", fmt.Errorf("Error reading spec file: %v", err)
+	}
+
+	version, found := readSpecVersion(specContent)
+	if !found {
+		return "", fmt.Errorf("Error: Could not find Version in spec file")
+	}
+
+	return version, nil
+}
+
+// VersionMacroRegex matches a Version tag holding nothing but a macro, as in
+// "Version: %{zen_version}"
+var versionMacroRegex = regexp.MustCompile(`(?m)^Version:\s+%\{?\??([A-Za-z_][A-Za-z0-9_]*)\}?[ \t]*\r?$`)
+
+// VersionMacroDefinition returns a regexp matching the %global or %define
+// line of a macro, capturing its value
+func versionMacroDefinition(macro string) *regexp.Regexp {
+	return regexp.MustCompile(`(?m)^(%(?:global|define)\s+` + regexp.QuoteMeta(macro) + `\s+)([^\s]+)`)
+}
+
+// SpecVersionMacro returns the macro the spec's Version tag refers to when
+// the version is kept in a %global or %define, or "" when Version holds the
+// version itself
+func specVersionMacro(content []byte) string {
+	m := versionMacroRegex.FindSubmatch(content)
+	if m == nil || !versionMacroDefinition(string(m[1])).Match(content) {
+		return ""
+	}
+	return string(m[1])
+}
+
+// ReadSpecVersion returns the spec's version, following a Version tag that
+// refers to a %global or %define macro
+func readSpecVersion(content []byte) (string, bool) {
+	if macro := specVersionMacro(content); macro != "" {
+		return string(versionMacroDefinition(macro).FindSubmatch(content)[2]), true
+	}
+	versionMatches := regexp.MustCompile(`Version:\s+(.*)`).FindSubmatch(content)
+	if len(versionMatches) < 2 {
+		return "", false
+	}
+	return string(versionMatches[1]), true
+}
+
+// SetSpecVersion sets the spec's version: in the %global or %define macro
+// when Version refers to one, otherwise in the Version tag itself
+func setSpecVersion(content []byte, version string) []byte {
+	if macro := specVersionMacro(content); macro != "" {
+		definition := versionMacroDefinition(macro)
+		return definition.ReplaceAll(content, []byte("${1}"+strings.ReplaceAll(version, "$", "$$")))
+	}
+	versionRegex := regexp.MustCompile(`Version:\s+.*`)
+	return versionRegex.ReplaceAllLiteral(content, []byte("Version:        "+version))
+}
+
+// ProcessTargets runs processTarget for each target on up to
+// opts.Concurrency workers. The first failure cancels the remaining targets
+// and is returned; ErrUpToDate is returned when every target was already up
+// to date.
+func processTargets(ctx context.Context, cfg *RunConfig, opts *Options, targets []SpecTarget, sourcesDir string, state *State, summary *RunSummary) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := make(chan struct{}, max(opts.Concurrency, 1))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	upToDate := 0
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target SpecTarget) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			var err error
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}()
+			err = processTarget(ctx, cfg, opts, target, sourcesDir, state, summary)
+			if errors.Is(err, ErrUpToDate) {
+				mu.Lock()
+				upToDate++
+				mu.Unlock()
+				err = nil
+			}
+		}(target)
+	}
+	wg.Wait()
+	if firstErr == nil && upToDate == len(targets) {
+		return ErrUpToDate
+	}
+	return firstErr
+}
+
+// FetchSource downloads a release's tarball into SOURCES, verifying it as
+// --checksum-policy and --verify-internal-version ask, and returns what to
+// record about it. previous is what was recorded for the arch last time: the
+// file is reused if it is the same version, unless fresh is set, and its size
+// is compared with the new one. The release's expected checksum is filled in
+// when published.
+func fetchSource(ctx context.Context, cfg *RunConfig, opts *Options, release *ReleaseInfo, sourcesDir string, previous SourceChecksum, fresh bool) (SourceChecksum, DownloadStats, error) {
+	var err error
+	switch {
+	case opts.ChecksumPolicy == "skip":
+		out.Printf("Not verifying %s (--checksum-policy skip)\n", release.Filename)
+		release.SHA256 = ""
+	case opts.SourceSHA256 != "":
+		out.Printf("Verifying %s against --source-sha256\n", release.Filename)
+	case release.SHA256 != "":
+		out.Printf("Using the digest of %s from the release\n", release.Filename)
+	case release.ChecksumURL != "":
+		release.SHA256, err = fetchChecksum(*release)
+		if err != nil {
+			return SourceChecksum{}, DownloadStats{}, err
+		}
+		out.Explainf("expected checksum of %s is %s, from the release's checksum manifest", release.Filename, release.SHA256)
+	case opts.ChecksumPolicy == "require":
+		return SourceChecksum{}, DownloadStats{}, fmt.Errorf("no checksum published for %s (--checksum-policy require)", release.Filename)
+	default:
+		out.Printf("Warning: no checksum published for %s, downloading unverified\n", release.Filename)
+		out.Explainf("the release publishes no checksum for %s and --checksum-policy is prefer, so it is used unverified", release.Filename)
+	}
+
+	// A tarball from an earlier attempt at this version can be reused
+	var cachedSHA256 string
+	if previous.Version == release.Version {
+		cachedSHA256 = previous.SHA256
+	}
+
+	out.Printf("Downloading %s source...\n", release.Arch)
+	sourcePath, checksum, stats, err := downloadSource(ctx, cfg, sourcesDir, *release, cachedSHA256, fresh)
+	if err != nil {
+		return SourceChecksum{}, DownloadStats{}, err
+	}
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return SourceChecksum{}, DownloadStats{}, err
+	}
+	if err := checkSizeRegression(*release, info.Size(), previous, opts.SizeThreshold, opts.SizeStrict); err != nil {
+		return SourceChecksum{}, DownloadStats{}, err
+	}
+	if opts.VerifyExtract {
+		if err := verifyExtract(sourcePath, cfg.WorkDir); err != nil {
+			return SourceChecksum{}, DownloadStats{}, err
+		}
+	}
+	if opts.VerifyInternal {
+		if err := verifyInternalVersion(sourcePath, *release); err != nil {
+			return SourceChecksum{}, DownloadStats{}, err
+		}
+	}
+	if release.SHA256 != "" {
+		out.Explainf("checksum of %s verified: %s", release.Filename, checksum)
+	}
+	if opts.ReportDownloadSpeed && stats.Bytes > 0 {
+		out.Printf("Downloaded %s in %.1fs (%.2f MiB/s)\n", formatSize(stats.Bytes), stats.Seconds, stats.MiBPerSecond)
+	}
+	return SourceChecksum{Version: release.Version, SHA256: checksum, Size: info.Size()}, stats, nil
+}
+
+// CheckSizeRegression compares a new tarball's size with the previous one
+// recorded for its arch. One smaller than threshold times the previous size
+// suggests a broken release or the wrong asset: it is a warning, or an
+// ErrSizeRegression with strict.
+func checkSizeRegression(release ReleaseInfo, size int64, previous SourceChecksum, threshold float64, strict bool) error {
+	if previous.Size <= 0 {
+		return nil
+	}
+	out.Printf("Size of %s: %s (previous, %s: %s)\n", release.Filename, formatSize(size), previous.Version, formatSize(previous.Size))
+	if threshold <= 0 || float64(size) >= threshold*float64(previous.Size) {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s is %s, %.0f%% of the previous %s (%s); the release may be broken",
+		ErrSizeRegression, release.Filename, formatSize(size), 100*float64(size)/float64(previous.Size), formatSize(previous.Size), previous.Version)
+	if strict {
+		return err
+	}
+	out.Printf("Warning: %v\n", err)
+	return nil
+}
+
+// ProcessTarget downloads, updates, builds and submits one spec file if it
+// is behind the latest release, returning ErrUpToDate if it is not
+func processTarget(ctx context.Context, cfg *RunConfig, opts *Options, target SpecTarget, sourcesDir string, state *State, summary *RunSummary) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cfg.targetMu.Lock()
+	defer cfg.targetMu.Unlock()
+
+	specFilePath := target.SpecFile
+	releaseInfo := target.Releases[0]
+
+	// Check if this is a new version
+	currentVersion := opts.AssumeVersion
+	var err error
+	if currentVersion == "" {
+		currentVersion, err = specVersion(specFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	summary.CurrentVersion = currentVersion
+	if opts.AssumeVersion != "" {
+		out.Explainf("current version is %s, from --assume-version", currentVersion)
+	} else {
+		out.Explainf("%s has version %s", filepath.Base(specFilePath), currentVersion)
+	}
+
+	// Falling back past a skipped release never downgrades the package
+	if releaseInfo.Fallback && compareVersions(currentVersion, releaseInfo.Version) > 0 {
+		out.Printf("%s is newer than %s, the newest release not skipped\n", currentVersion, releaseInfo.Version)
+		out.Explainf("%s > %s and the release is an older fallback, so not downgrading", currentVersion, releaseInfo.Version)
+		return ErrUpToDate
+	}
+
+	respin := false
+	if currentVersion == releaseInfo.Version {
+		if opts.DetectRespin {
+			out.Explainf("%s = %s, but --detect-respin is on, so checking whether the tarballs changed upstream", releaseInfo.Version, currentVersion)
+			respin, err = detectRespin(ctx, cfg, opts, target.Releases, sourcesDir, state)
+			if err != nil {
+				return err
+			}
+		}
+		if !respin {
+			out.Printf("Already at the latest version: %s\n", currentVersion)
+			out.Explainf("%s = %s, so there is nothing to update", releaseInfo.Version, currentVersion)
+			return ErrUpToDate
+		}
+	} else if compareVersions(releaseInfo.Version, currentVersion) > 0 {
+		out.Explainf("%s > %s, so proceeding", releaseInfo.Version, currentVersion)
+	} else {
+		out.Explainf("%s < %s, but the spec follows the latest release, so proceeding", releaseInfo.Version, currentVersion)
+	}
+
+	// From here on there is an update, so anything held back is shown
+	out.flush()
+	if respin {
+		out.Printf("Tarball for %s changed upstream, rebuilding\n", releaseInfo.Version)
+	} else {
+		out.Printf("New version found: %s\n", releaseInfo.Version)
+	}
+
+	// New versions are still reported during a freeze, just not built
+	if time.Now().Before(opts.FreezeUntil) {
+		out.Explainf("--freeze-until is %s, so the update is reported but not built", opts.FreezeUntil.Format(time.RFC3339))
+		return &FreezeError{Version: releaseInfo.Version, Until: opts.FreezeUntil}
+	}
+
+	project, err := target.coprProject(opts.CoprProject)
+	if err != nil {
+		return err
+	}
+	var stagingProject string
+	if opts.StagingProject != "" {
+		if stagingProject, err = target.coprProject(opts.StagingProject); err != nil {
+			return err
+		}
+	}
+
+	// Expired credentials are caught before downloading and building rather
+	// than at submit, unless --copr-preflight already checked them
+	if !opts.NoSubmit && !opts.CoprPreflight {
+		if err := cfg.checkCoprAuth(); err != nil {
+			return err
+		}
+	}
+
+	// Refuse up front rather than sweep someone's work into the bump commit
+	if opts.GitCommit && !opts.AllowDirty {
+		rpmbuildPath := filepath.Dir(sourcesDir)
+		dirty, err := gitDirtyFiles(filepath.Dir(specFilePath), toolOutputs(rpmbuildPath, stateFilePath(opts, rpmbuildPath)))
+		if err != nil {
+			return err
+		}
+		if len(dirty) > 0 {
+			return fmt.Errorf("refusing to commit version bump, work tree has uncommitted changes (use --allow-dirty to override):\n  %s",
+				strings.Join(dirty, "\n  "))
+		}
+	}
+
+	summary.SpecFile = specFilePath
+	originalSpec, err := os.ReadFile(specFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading spec file: %v", err)
+	}
+
+	// With --temp-spec every edit and the build use a copy next to the spec,
+	// which replaces it only after a successful submit, so a failed run
+	// leaves the real spec untouched
+	workSpec := specFilePath
+	promoteSpec := func() error { return nil }
+	if opts.TempSpec {
+		workSpec, err = tempSpecCopy(specFilePath, originalSpec)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(workSpec)
+		promoteSpec = func() error {
+			if err := os.Rename(workSpec, specFilePath); err != nil {
+				return fmt.Errorf("error replacing spec file: %v", err)
+			}
+			out.Printf("Updated %s\n", specFilePath)
+			return nil
+		}
+	}
+
+	if respin {
+		// The new tarballs were already downloaded to compare checksums
+		out.Println("Bumping spec release...")
+		message := "Rebuild for re-released upstream tarball"
+		if opts.ChangelogMessage != "" {
+			message = changelogItems(opts.ChangelogMessage)
+		}
+		err = bumpSpecRelease(workSpec, message, cfg.Changelog)
+		if err != nil {
+			return err
+		}
+		summary.Respin = true
+	} else {
+		summary.beginPhase("download")
+		if opts.MinFreeSpace > 0 && opts.SourceFile == "" {
+			if err := checkFreeSpace(ctx, sourcesDir, opts.MinFreeSpace, target.Releases); err != nil {
+				return err
+			}
+		}
+
+		for i := range target.Releases {
+			release := &target.Releases[i]
+
+			// A local tarball is used as is: it is not upstream's, so it is
+			// neither verified nor recorded as the release's checksum
+			if opts.SourceFile != "" {
+				out.Printf("Using local source %s for %s\n", opts.SourceFile, release.Arch)
+				checksum, err := useSourceFile(opts.SourceFile, sourcesDir, *release)
+				if err != nil {
+					return err
+				}
+				out.Printf("Local source SHA-256: %s\n", checksum)
+				summary.recordSourceChecksum(release.Arch, checksum)
+				continue
+			}
+
+			// Each arch has its own file in SOURCES, so other targets can
+			// carry on while this one downloads
+			previous := state.Checksums[release.Arch]
+			source, stats, err := func() (SourceChecksum, DownloadStats, error) {
+				cfg.targetMu.Unlock()
+				defer cfg.targetMu.Lock()
+				return fetchSource(ctx, cfg, opts, release, sourcesDir, previous, false)
+			}()
+			if err != nil {
+				return err
+			}
+			recordChecksum(state, release.Arch, source)
+			summary.recordSourceChecksum(release.Arch, source.SHA256)
+			if opts.ReportDownloadSpeed {
+				summary.recordDownload(release.Arch, stats)
+			}
+		}
+
+		summary.beginPhase("update spec")
+		out.Println("Updating spec file...")
+		message := "Update to " + releaseInfo.Version
+		if opts.ChangelogAll || opts.SinceTag != "" {
+			previous := currentVersion
+			if opts.SinceTag != "" {
+				previous = rpmVersion(opts.SinceTag, opts.VersionPrefix)
+			}
+			message = intermediateChangelog(opts.VersionPrefix, previous, releaseInfo.Version, opts.GitHubToken)
+		}
+		if opts.ChangelogMessage != "" {
+			message = changelogItems(opts.ChangelogMessage)
+		}
+		err = updateSpecFile(workSpec, target.Releases, message, cfg.Changelog)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.ShipChangelog {
+		if err := shipReleaseNotes(workSpec, sourcesDir, releaseInfo); err != nil {
+			return err
+		}
 	}
-
-	// For GitHub Actions running in Fedora container
-	if _, err := os.Stat("/root/rpmbuild"); err == nil {
-		return "/root/rpmbuild"
+	if len(opts.SetFields) > 0 {
+		if err := setSpecFields(workSpec, opts.SetFields); err != nil {
+			return err
+		}
+	}
+	if err := checkSourceNames(workSpec, sourcesDir, target.Releases, opts.AlignSourceName); err != nil {
+		return err
 	}
+	summary.Updated = true
+	summary.SpecDiff = diffSpec(originalSpec, workSpec, cfg.WorkDir)
 
-	// Default to user's home directory
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		fmt.Println("Error getting home directory:", err)
-		os.Exit(1)
+	// Don't start a build once a shutdown has been requested
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return filepath.Join(homeDir, "rpmbuild")
-}
 
-// GetLatestRelease fetches the latest release information from GitHub
-func getLatestRelease() (*ReleaseInfo, error) {
-	resp, err := http.Get(githubAPIURL)
+	summary.beginPhase("build")
+	out.Println("Building SRPM...")
+	srpmPath, buildLog, err := buildSRPM(cfg, workSpec, opts.SaveBuildLogs)
+	summary.BuildLog = buildLog
 	if err != nil {
-		return nil, fmt.Errorf("error accessing GitHub API: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
+	summary.SRPMPath = srpmPath
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error accessing GitHub API: %d", resp.StatusCode)
+	jsonSummary := opts.OutputFormat == "json" && (opts.SummaryFile != "" || opts.SummaryStdout)
+	if opts.SRPMChecksum || opts.SRPMSHA512 || jsonSummary {
+		summary.SRPMSHA256, summary.SRPMSHA512, err = writeSRPMChecksums(strings.TrimPrefix(srpmPath, "Wrote: "), opts.SRPMSHA512)
+		if err != nil {
+			return err
+		}
+		out.Printf("SRPM SHA-256: %s\n", summary.SRPMSHA256)
+		if summary.SRPMSHA512 != "" {
+			out.Printf("SRPM SHA-512: %s\n", summary.SRPMSHA512)
+		}
 	}
 
-	var release GitHubRelease
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		return nil, fmt.Errorf("error parsing GitHub API response: %v", err)
+	if opts.Rpmlint {
+		summary.beginPhase("rpmlint")
+		out.Println("Running rpmlint...")
+		if err := runRpmlint(srpmPath, opts.RpmlintFailOn, opts.RpmlintRequire, opts.RpmlintIgnore); err != nil {
+			return err
+		}
 	}
 
-	version := release.TagName
-
-	// Skip twilight/nightly builds (containing 't' in version)
-	if strings.Contains(version, "t") {
-		fmt.Printf("Skipping twilight/nightly build version: %s\n", version)
-		return nil, nil
+	if opts.ArtifactUpload != "" {
+		summary.beginPhase("artifact upload")
+		out.Printf("Uploading SRPM to %s...\n", opts.ArtifactUpload)
+		if err := uploadArtifacts(ctx, opts, strings.TrimPrefix(srpmPath, "Wrote: ")); err != nil {
+			return err
+		}
 	}
 
-	// Find the Linux x86_64 asset
-	var linuxAssetURL string
-	for _, asset := range release.Assets {
-		if strings.Contains(asset.Name, "linux-x86_64.tar.xz") {
-			linuxAssetURL = asset.DownloadURL
-			break
+	// The bump is committed once the spec is final, with or without a submit
+	commitSpec := func() error {
+		if !opts.GitCommit {
+			return nil
 		}
+		summary.beginPhase("git commit")
+		out.Println("Committing spec file...")
+		return gitCommitSpec(specFilePath, releaseInfo.Version)
 	}
 
-	if linuxAssetURL == "" {
-		return nil, fmt.Errorf("could not find Linux x86_64 asset in the release")
+	if opts.NoSubmit {
+		out.Printf("Not submitting to COPR (--no-submit), SRPM left at %s\n", srpmPath)
+		out.Explainf("--no-submit is set, so stopping after the SRPM build")
+		if err := promoteSpec(); err != nil {
+			return err
+		}
+		return commitSpec()
 	}
 
-	return &ReleaseInfo{
-		Version:     version,
-		DownloadURL: fmt.Sprintf("https://github.com/zen-browser/desktop/releases/download/%s/zen.linux-x86_64.tar.xz", version),
-		Filename:    "zen.linux-x86_64.tar.xz",
-		PublishedAt: release.PublishedAt,
-	}, nil
-}
-
-// UpdateSpecFile updates the spec file with the new version information
-func updateSpecFile(specFilePath string, releaseInfo *ReleaseInfo) error {
-	content, err := os.ReadFile(specFilePath)
-	if err != nil {
-		return fmt.Errorf("error reading spec file: %v", err)
+	// The very same tarballs already built in COPR need no second build
+	buildID := ""
+	if opts.CompareCoprChecksum {
+		buildID = matchingCoprBuild(project, state, target.Releases)
 	}
+	if buildID != "" {
+		summary.BuildID = buildID
+		summary.BuildURL = coprBuildURL(buildID)
+	} else {
+		if opts.PreSubmitHook != "" {
+			summary.beginPhase("pre-submit hook")
+			if err := runHook(opts.PreSubmitHook, nil, strings.TrimPrefix(srpmPath, "Wrote: ")); err != nil {
+				return err
+			}
+		}
 
-	// Update main version
-	versionRegex := regexp.MustCompile(`Version:\s+.*`)
-	updatedContent := versionRegex.ReplaceAllString(string(content), fmt.Sprintf("Version:        %s", releaseInfo.Version))
+		// Production only gets what already built in staging
+		if stagingProject != "" {
+			summary.beginPhase("staging")
+			out.Printf("Building in staging project %s first...\n", stagingProject)
+			stagingID, err := submitToCopr(stagingProject, srpmPath, resolveChroots(opts.Chroots, stagingProject, cfg.ProjectChroots), true, coprBuildArgs(opts))
+			if err != nil {
+				return err
+			}
+			summary.StagingBuildID = stagingID
+			if err := waitForCoprBuild(ctx, stagingID, opts.FetchFailureLogs); err != nil {
+				return fmt.Errorf("staging in %s: %w; not submitting to %s", stagingProject, err, project)
+			}
+		}
 
-	// Update Source0 URL
-	sourceURL := fmt.Sprintf("https://github.com/zen-browser/desktop/releases/download/%s/zen.linux-x86_64.tar.xz", releaseInfo.Version)
-	sourceRegex := regexp.MustCompile(`Source0:\s+.*`)
-	updatedContent = sourceRegex.ReplaceAllString(updatedContent, fmt.Sprintf("Source0:        %s", sourceURL))
+		summary.beginPhase("submit")
+		out.Println("Submitting to COPR...")
+		// A background build is not waited for by copr-cli either; --wait
+		// polls for it instead
+		nowait := opts.Wait || opts.CoprBackground
+		buildID, err = submitToCopr(project, srpmPath, resolveChroots(opts.Chroots, project, cfg.ProjectChroots), nowait, coprBuildArgs(opts))
+		if err != nil {
+			return err
+		}
+		summary.BuildID = buildID
+		if buildID != "" {
+			summary.BuildURL = coprBuildURL(buildID)
+		}
+		if opts.Wait {
+			summary.beginPhase("wait")
+			if err := waitForCoprBuild(ctx, buildID, opts.FetchFailureLogs); err != nil {
+				return err
+			}
+		}
+		recordCoprBuild(state, project, buildID, target.Releases)
+	}
+	if err := promoteSpec(); err != nil {
+		return err
+	}
 
-	// Update desktop entry version
-	desktopEntryRegex := regexp.MustCompile(`\[Desktop Entry\]\nVersion=.*`)
-	updatedContent = desktopEntryRegex.ReplaceAllString(updatedContent, fmt.Sprintf("[Desktop Entry]\nVersion=%s", releaseInfo.Version))
+	if opts.CoprPruneKeep > 0 {
+		summary.beginPhase("prune")
+		out.Printf("Pruning COPR builds, keeping the %d most recent...\n", opts.CoprPruneKeep)
+		if err := pruneCoprBuilds(project, packageName, opts.CoprPruneKeep); err != nil {
+			return err
+		}
+	}
 
-	// Add new changelog entry
-	today := time.Now().Format("Mon Jan 2 2006")
-	changelogEntry := fmt.Sprintf("%%changelog\n* %s COPR Build System <copr-build@fedoraproject.org> - %s-1\n- Update to %s\n",
-		today, releaseInfo.Version, releaseInfo.Version)
-	changelogRegex := regexp.MustCompile(`%changelog.*`)
-	updatedContent = changelogRegex.ReplaceAllString(updatedContent, changelogEntry)
+	if opts.ArchiveSRPM {
+		summary.beginPhase("archive")
+		out.Printf("Archiving SRPM to GitHub repository %s...\n", opts.ArchiveRepo)
+		if err := archiveSRPMToGitHub(opts.ArchiveRepo, releaseInfo.Version, srpmPath, opts.GitHubToken); err != nil {
+			return err
+		}
+	}
 
-	// Write the updated content back
-	return os.WriteFile(specFilePath, []byte(updatedContent), 0644)
-}
+	if err := commitSpec(); err != nil {
+		return err
+	}
 
-// DownloadSource downloads the source tarball
-func downloadSource(sourcesDir, downloadURL, filename string) (string, error) {
-	// Ensure the SOURCES directory exists
-	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
-		return "", fmt.Errorf("error creating SOURCES directory: %v", err)
+	// The update is done by now, so a failing hook only warrants a warning
+	if opts.PostSuccessHook != "" {
+		summary.beginPhase("post-success hook")
+		env := []string{
+			"ZEN_VERSION=" + releaseInfo.Version,
+			"ZEN_BUILD_ID=" + buildID,
+			"ZEN_BUILD_URL=" + summary.BuildURL,
+			"ZEN_COPR_PROJECT=" + project,
+		}
+		if err := runHook(opts.PostSuccessHook, env); err != nil {
+			out.Printf("Warning: %v\n", err)
+		}
 	}
 
-	sourcePath := filepath.Join(sourcesDir, filename)
+	return nil
+}
 
-	// Download the file
-	resp, err := http.Get(downloadURL)
+// TempSpecCopy writes content to a new hidden file beside the spec, so it is
+// built with the same rpmbuild tree and can be renamed over the spec
+func tempSpecCopy(specFilePath string, content []byte) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(specFilePath), "."+strings.TrimSuffix(filepath.Base(specFilePath), ".spec")+"-*.spec")
 	if err != nil {
-		return "", fmt.Errorf("error downloading source: %v", err)
+		return "", fmt.Errorf("error creating temporary spec: %v", err)
 	}
-	defer resp.Body.Close()
+	defer file.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error downloading source: %d", resp.StatusCode)
+	// Keep the spec's permissions once the copy is renamed over it
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(specFilePath); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = file.Chmod(mode)
+	if err == nil {
+		_, err = file.Write(content)
 	}
-
-	file, err := os.Create(sourcePath)
 	if err != nil {
-		return "", fmt.Errorf("error creating source file: %v", err)
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error writing temporary spec: %v", err)
 	}
-	defer file.Close()
+	return file.Name(), file.Close()
+}
 
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error saving source file: %v", err)
+// DetectRespin downloads the tarballs of an unchanged version and reports
+// whether any checksum differs from the one recorded for that version. When
+// none was recorded yet, the current one is stored and no rebuild happens.
+func detectRespin(ctx context.Context, cfg *RunConfig, opts *Options, releases []ReleaseInfo, sourcesDir string, state *State) (bool, error) {
+	respin := false
+	for i := range releases {
+		release := &releases[i]
+		// Always fetch again, the point is to see what upstream serves now,
+		// verified like any other download
+		out.Printf("Downloading %s source to compare checksums...\n", release.Arch)
+		previous, ok := state.Checksums[release.Arch]
+		source, _, err := fetchSource(ctx, cfg, opts, release, sourcesDir, previous, true)
+		if err != nil {
+			return false, err
+		}
+
+		if ok && previous.Version == release.Version && previous.SHA256 != source.SHA256 {
+			out.Printf("Checksum of %s changed: %s -> %s\n", release.Filename, previous.SHA256, source.SHA256)
+			respin = true
+		}
+		recordChecksum(state, release.Arch, source)
 	}
+	return respin, nil
+}
 
-	return sourcePath, nil
+// RecordChecksum stores the checksum and size of an arch's downloaded
+// tarball in the state
+func recordChecksum(state *State, arch string, source SourceChecksum) {
+	if state.Checksums == nil {
+		state.Checksums = make(map[string]SourceChecksum)
+	}
+	state.Checksums[arch] = source
 }
 
-// BuildSRPM builds the SRPM package
-func buildSRPM(specFilePath string) (string, error) {
-	cmd := exec.Command("rpmbuild", "-bs", specFilePath)
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// CoprBuildRecord is a COPR build submitted for a version, with the
+// SHA-256 of the tarball of each arch it was built from
+type CoprBuildRecord struct {
+	BuildID      string            `json:"build_id"`
+	Version      string            `json:"version"`
+	SourceSHA256 map[string]string `json:"source_sha256"`
+}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("error building SRPM: %v\nStderr: %s", err, stderr.String())
+// RecordCoprBuild remembers the build submitted to project and the tarballs
+// it was built from, for --compare-checksum-with-copr
+func recordCoprBuild(state *State, project, buildID string, releases []ReleaseInfo) {
+	if state == nil || buildID == "" {
+		return
+	}
+	record := CoprBuildRecord{BuildID: buildID, Version: releases[0].Version, SourceSHA256: make(map[string]string)}
+	for _, release := range releases {
+		record.SourceSHA256[release.Arch] = state.Checksums[release.Arch].SHA256
 	}
+	if state.CoprBuilds == nil {
+		state.CoprBuilds = make(map[string]CoprBuildRecord)
+	}
+	state.CoprBuilds[project] = record
+}
 
-	// Try to find the SRPM path from the output
-	srpmPath := findSRPMInOutput(stdout.String(), stderr.String())
-	if srpmPath == "" {
-		srpmPath = findSRPMInSpec(specFilePath)
+// MatchingCoprBuild returns the ID of the last build submitted to project
+// when it was built from the same tarballs as releases and succeeded, or ""
+// to submit as usual. COPR does not expose the checksums of a build's
+// sources, so they are the ones recorded in the state when it was submitted.
+func matchingCoprBuild(project string, state *State, releases []ReleaseInfo) string {
+	record, ok := state.CoprBuilds[project]
+	if !ok {
+		out.Printf("No earlier build of %s recorded, submitting\n", project)
+		return ""
 	}
-	if srpmPath == "" {
-		srpmPath = findSRPMInDirectory(filepath.Join(filepath.Dir(filepath.Dir(specFilePath)), "SRPMS"))
+	for _, release := range releases {
+		checksum := state.Checksums[release.Arch].SHA256
+		if checksum == "" || record.SourceSHA256[release.Arch] != checksum {
+			out.Printf("COPR build %s was built from other sources for %s, submitting\n", record.BuildID, release.Arch)
+			return ""
+		}
 	}
 
-	if srpmPath == "" {
-		return "", fmt.Errorf("could not find built SRPM path in output\nStdout: %s\nStderr: %s",
-			stdout.String(), stderr.String())
+	stdout, _, err := coprCLI("status", record.BuildID)
+	if err != nil {
+		out.Printf("Could not check COPR build %s, submitting: %v\n", record.BuildID, err)
+		return ""
+	}
+	if status := strings.TrimSpace(stdout); status != "succeeded" {
+		out.Printf("COPR build %s of the same sources %s, submitting\n", record.BuildID, status)
+		return ""
 	}
+	out.Printf("COPR build %s already built these sources, not submitting again\n", record.BuildID)
+	return record.BuildID
+}
 
-	fmt.Printf("Found SRPM: %s\n", srpmPath)
-	return srpmPath, nil
+// GitHubRepoRelease is the part of a release of our own repository needed
+// to upload assets to it
+type GitHubRepoRelease struct {
+	ID        int64  `json:"id"`
+	UploadURL string `json:"upload_url"`
+	HTMLURL   string `json:"html_url"`
 }
 
-// FindSRPMInOutput extracts SRPM path from command output
-func findSRPMInOutput(stdout, stderr string) string {
-	// First check stderr
-	scanner := bufio.NewScanner(strings.NewReader(stderr))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasSuffix(line, ".src.rpm") {
-			return strings.TrimPrefix(strings.TrimSpace(line), "Wrote: ")
-		}
+// ArchiveSRPMToGitHub uploads the SRPM as an asset of the release tagged
+// with the version in repo, creating the release if it does not exist yet
+func archiveSRPMToGitHub(repo, tag, srpmPath, token string) error {
+	if token == "" && githubApp == nil {
+		return fmt.Errorf("archiving SRPM to GitHub requires GITHUB_TOKEN, --github-token-file or --github-app-id")
 	}
+	srpmPath = strings.TrimPrefix(srpmPath, "Wrote: ")
 
-	// Then check stdout
-	scanner = bufio.NewScanner(strings.NewReader(stdout))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasSuffix(line, ".src.rpm") {
-			return strings.TrimPrefix(strings.TrimSpace(line), "Wrote: ")
-		}
+	release, err := githubRepoRelease(repo, tag, token)
+	if err != nil {
+		return err
 	}
 
-	return ""
-}
+	file, err := os.Open(srpmPath)
+	if err != nil {
+		return fmt.Errorf("error opening SRPM: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error opening SRPM: %v", err)
+	}
 
-// FindSRPMInSpec finds SRPM based on spec file version info
-func findSRPMInSpec(specFilePath string) string {
-	content, err := os.ReadFile(specFilePath)
+	// upload_url is a URI template ending in {?name,label}
+	uploadURL := release.UploadURL
+	if i := strings.Index(uploadURL, "{"); i >= 0 {
+		uploadURL = uploadURL[:i]
+	}
+	uploadURL += "?name=" + url.QueryEscape(filepath.Base(srpmPath))
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL, file)
 	if err != nil {
-		return ""
+		return fmt.Errorf("error uploading SRPM: %v", err)
 	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/x-rpm")
+	setGitHubHeaders(req, token)
 
-	// Extract version
-	versionRegex := regexp.MustCompile(`Version:\s+(.*)`)
-	versionMatches := versionRegex.FindStringSubmatch(string(content))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error uploading SRPM: %v", err)
+	}
+	defer resp.Body.Close()
 
-	// Extract release
-	releaseRegex := regexp.MustCompile(`Release:\s+(.*)`)
-	releaseMatches := releaseRegex.FindStringSubmatch(string(content))
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		out.Printf("Archived %s to %s\n", filepath.Base(srpmPath), release.HTMLURL)
+		return nil
+	case http.StatusUnprocessableEntity:
+		// GitHub rejects a second asset with the same name
+		out.Printf("%s is already archived in %s\n", filepath.Base(srpmPath), release.HTMLURL)
+		return nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error uploading SRPM: %d\n%s", resp.StatusCode, body)
+	}
+}
 
-	if len(versionMatches) > 1 && len(releaseMatches) > 1 {
-		version := versionMatches[1]
-		release := strings.Replace(releaseMatches[1], "%{?dist}", ".fc41", 1)
+// GitHubRepoRelease returns the release for tag in repo, creating it if needed
+func githubRepoRelease(repo, tag, token string) (*GitHubRepoRelease, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://api.github.com/repos/%s/releases/tags/%s", repo, url.PathEscape(tag)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up archive release: %v", err)
+	}
+	setGitHubHeaders(req, token)
 
-		srpmDir := filepath.Join(filepath.Dir(filepath.Dir(specFilePath)), "SRPMS")
-		expectedPath := filepath.Join(srpmDir, fmt.Sprintf("zen-browser-%s-%s.src.rpm", version, release))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up archive release: %v", err)
+	}
+	defer resp.Body.Close()
 
-		if _, err := os.Stat(expectedPath); err == nil {
-			return expectedPath
-		}
+	if resp.StatusCode == http.StatusNotFound {
+		return createGitHubRepoRelease(repo, tag, token)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error looking up archive release: %d", resp.StatusCode)
 	}
 
-	return ""
+	var release GitHubRepoRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("error parsing archive release: %v", err)
+	}
+	return &release, nil
 }
 
-// FindSRPMInDirectory finds most recent SRPM in SRPMS directory
-func findSRPMInDirectory(srpmsDir string) string {
-	if err := os.MkdirAll(srpmsDir, 0755); err != nil {
-		fmt.Printf("Error creating SRPMS directory: %v\n", err)
-		return ""
+// CreateGitHubRepoRelease creates a release for tag in repo
+func createGitHubRepoRelease(repo, tag, token string) (*GitHubRepoRelease, error) {
+	payload, err := json.Marshal(map[string]string{
+		"tag_name": tag,
+		"name":     "Zen Browser " + tag,
+		"body":     "Source RPM submitted to COPR for Zen Browser " + tag + ".",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive release: %v", err)
 	}
 
-	files, err := os.ReadDir(srpmsDir)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://api.github.com/repos/%s/releases", repo), bytes.NewReader(payload))
 	if err != nil {
-		fmt.Printf("Error listing SRPMS directory: %v\n", err)
-		return ""
+		return nil, fmt.Errorf("error creating archive release: %v", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	setGitHubHeaders(req, token)
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".src.rpm") {
-			fmt.Printf(" - %s\n", file.Name())
-			return filepath.Join(srpmsDir, file.Name())
-		}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive release: %v", err)
 	}
+	defer resp.Body.Close()
 
-	return ""
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("error creating archive release: %d\n%s", resp.StatusCode, body)
+	}
+
+	var release GitHubRepoRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("error parsing archive release: %v", err)
+	}
+	out.Printf("Created release %s in %s\n", tag, repo)
+	return &release, nil
 }
 
-// SubmitToCopr submits the SRPM to COPR for building
-func submitToCopr(srpmPath string) error {
-	// Strip "Wrote: " prefix if present
-	srpmPath = strings.TrimPrefix(srpmPath, "Wrote: ")
+// SetGitHubHeaders adds the API version and token headers to a request
+func setGitHubHeaders(req *http.Request, token string) {
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token == "" && githubApp != nil {
+		var err error
+		if token, err = githubApp.token(); err != nil {
+			out.Printf("Warning: %v, continuing unauthenticated\n", err)
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
 
-	fmt.Printf("Submitting %s to COPR project %s...\n", srpmPath, coprProject)
+// ArtifactUploader stores a local file under a key in an artifact store
+type ArtifactUploader interface {
+	Upload(ctx context.Context, key, path string) error
+}
 
-	cmd := exec.Command("copr-cli", "build", coprProject, srpmPath)
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// Uploader used by --artifact-upload, replaceable in tests; nil means one
+// is created from the options and environment
+var artifactUploader ArtifactUploader
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error submitting to COPR: %v\nStderr: %s", err, stderr.String())
+// UploadArtifacts uploads the SRPM and a .sha256 file for it to the store
+// named by --artifact-upload
+func uploadArtifacts(ctx context.Context, opts *Options, srpmPath string) error {
+	bucket, prefix, err := parseS3URL(opts.ArtifactUpload)
+	if err != nil {
+		return err
+	}
+	uploader := artifactUploader
+	if uploader == nil {
+		if uploader, err = newS3Uploader(bucket, opts.S3Endpoint); err != nil {
+			return err
+		}
 	}
 
-	fmt.Printf("Successfully submitted to COPR: %s\n", stdout.String())
-
-	// Extract the build ID from the output
-	buildIDRegex := regexp.MustCompile(`Created builds: (\d+)`)
-	buildIDMatches := buildIDRegex.FindStringSubmatch(stdout.String())
-
-	if len(buildIDMatches) > 1 {
-		buildID := buildIDMatches[1]
-		fmt.Printf("Build ID: %s\n", buildID)
-		fmt.Printf("Build status URL: https://copr.fedorainfracloud.org/coprs/build/%s/\n", buildID)
+	checksumPath := srpmPath + ".sha256"
+	if _, err := os.Stat(checksumPath); err != nil {
+		sum, err := fileSHA256(srpmPath)
+		if err != nil {
+			return err
+		}
+		if err := writeChecksumFile(checksumPath, sum, srpmPath); err != nil {
+			return err
+		}
 	}
 
+	for _, path := range []string{srpmPath, checksumPath} {
+		key := strings.TrimPrefix(prefix+"/"+filepath.Base(path), "/")
+		if err := uploader.Upload(ctx, key, path); err != nil {
+			return err
+		}
+		out.Printf("Uploaded s3://%s/%s\n", bucket, key)
+	}
 	return nil
 }
 
-func main() {
-	fmt.Println("Checking for new Zen Browser releases...")
+// ParseS3URL splits s3://bucket/prefix into the bucket and key prefix
+func parseS3URL(value string) (string, string, error) {
+	rest, ok := strings.CutPrefix(value, "s3://")
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if !ok || bucket == "" {
+		return "", "", fmt.Errorf("invalid --artifact-upload %q: expected s3://bucket/prefix", value)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
 
-	// Set paths based on environment
-	rpmbuildPath := getRpmbuildPath()
-	specFilePath := filepath.Join(rpmbuildPath, "SPECS/zen-browser.spec")
-	sourcesDir := filepath.Join(rpmbuildPath, "SOURCES")
+// S3Uploader puts objects into an S3-compatible bucket with path-style
+// requests signed with AWS Signature Version 4
+type S3Uploader struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// NewS3Uploader configures an uploader from the standard AWS environment
+// variables
+func newS3Uploader(bucket, endpoint string) (*S3Uploader, error) {
+	uploader := &S3Uploader{
+		Endpoint:     endpoint,
+		Region:       os.Getenv("AWS_REGION"),
+		Bucket:       bucket,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if uploader.AccessKey == "" || uploader.SecretKey == "" {
+		return nil, fmt.Errorf("--artifact-upload needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if uploader.Region == "" {
+		uploader.Region = "us-east-1"
+	}
+	if uploader.Endpoint == "" {
+		uploader.Endpoint = "https://s3." + uploader.Region + ".amazonaws.com"
+	}
+	uploader.Endpoint = strings.TrimSuffix(uploader.Endpoint, "/")
+	return uploader, nil
+}
 
-	// Get latest release info
-	releaseInfo, err := getLatestRelease()
+// Upload sends the file with a single signed PUT
+func (u *S3Uploader) Upload(ctx context.Context, key, path string) error {
+	payloadHash, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
 	}
 
-	// Skip if we got nil due to twilight/nightly build
-	if releaseInfo == nil {
-		os.Exit(0)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.Endpoint+"/"+s3EscapePath(u.Bucket+"/"+key), file)
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %v", key, err)
 	}
+	req.ContentLength = info.Size()
+	u.sign(req, payloadHash, time.Now().UTC())
 
-	// Check if this is a new version
-	specContent, err := os.ReadFile(specFilePath)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		fmt.Printf("Error reading spec file: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("error uploading %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("error uploading %s: %d %s", key, resp.StatusCode, strings.TrimSpace(string(body)))
 	}
+	return nil
+}
 
-	versionRegex := regexp.MustCompile(`Version:\s+(.*)`)
-	versionMatches := versionRegex.FindStringSubmatch(string(specContent))
+// Sign adds the SigV4 Authorization header for a request whose body has the
+// given SHA-256
+func (u *S3Uploader) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if u.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", u.SessionToken)
+		headers["x-amz-security-token"] = u.SessionToken
+	}
 
-	if len(versionMatches) < 2 {
-		fmt.Println("Error: Could not find Version in spec file")
-		os.Exit(1)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
 	}
+	signedHeaders := strings.Join(names, ";")
 
-	currentVersion := versionMatches[1]
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + u.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
 
-	if currentVersion == releaseInfo.Version {
-		fmt.Printf("Already at the latest version: %s\n", currentVersion)
-		return
+	key := []byte("AWS4" + u.SecretKey)
+	for _, part := range []string{date, u.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
 	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
 
-	fmt.Printf("New version found: %s\n", releaseInfo.Version)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.AccessKey, scope, signedHeaders, signature))
+}
 
-	fmt.Println("Downloading source...")
-	_, err = downloadSource(sourcesDir, releaseInfo.DownloadURL, releaseInfo.Filename)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// HmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// S3EscapePath percent-encodes each segment of an object path the way SigV4
+// expects, keeping the slashes
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
 	}
+	return strings.Join(segments, "/")
+}
 
-	fmt.Println("Updating spec file...")
-	err = updateSpecFile(specFilePath, releaseInfo)
+// GitDirtyFiles lists the tracked files with uncommitted changes in the git
+// work tree containing dir. Untracked files are left out, as are the paths
+// in ignore and anything below them, which are absolute.
+func gitDirtyFiles(dir string, ignore []string) ([]string, error) {
+	top, stderr, err := runCommand("git", "-C", dir, "rev-parse", "--show-toplevel")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error checking git status: %v\nStderr: %s", err, stderr)
 	}
-
-	fmt.Println("Building SRPM...")
-	srpmPath, err := buildSRPM(specFilePath)
+	top = strings.TrimSpace(top)
+	stdout, stderr, err := runCommand("git", "-C", dir, "status", "--porcelain", "--untracked-files=no")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error checking git status: %v\nStderr: %s", err, stderr)
 	}
 
-	fmt.Println("Submitting to COPR...")
-	err = submitToCopr(srpmPath)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	var files []string
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		// Porcelain lines are "XY path", relative to the top of the tree
+		line := scanner.Text()
+		if len(line) <= 3 {
+			continue
+		}
+		path := filepath.Join(top, line[3:])
+		ignored := false
+		for _, prefix := range ignore {
+			ignored = ignored || path == prefix || strings.HasPrefix(path, prefix+string(filepath.Separator))
+		}
+		if !ignored {
+			files = append(files, line[3:])
+		}
 	}
+	return files, nil
+}
+
+// Names of the lock and default state files in the rpmbuild tree
+const (
+	lockFileName  = "zen-browser.lock"
+	stateFileName = "zen-browser-state.json"
+)
+
+// StateFilePath is the --state-file, or the default one in the rpmbuild tree
+func stateFilePath(opts *Options, rpmbuildPath string) string {
+	if opts.StateFile != "" {
+		return opts.StateFile
+	}
+	return filepath.Join(rpmbuildPath, stateFileName)
+}
+
+// ToolOutputs lists what the tool itself writes in the rpmbuild tree, which
+// never counts as a maintainer's uncommitted work
+func toolOutputs(rpmbuildPath, statePath string) []string {
+	outputs := []string{filepath.Join(rpmbuildPath, lockFileName)}
+	if abs, err := filepath.Abs(statePath); err == nil {
+		outputs = append(outputs, abs)
+	}
+	for _, dir := range rpmbuildSubdirs {
+		if dir != "SPECS" {
+			outputs = append(outputs, filepath.Join(rpmbuildPath, dir))
+		}
+	}
+	return outputs
+}
 
-	fmt.Println("Done!")
+// GitCommitSpec commits only the spec file, leaving anything else untouched
+func gitCommitSpec(specFilePath, version string) error {
+	dir := filepath.Dir(specFilePath)
+	name := filepath.Base(specFilePath)
+	message := fmt.Sprintf("Update zen-browser spec file to version %s", version)
+
+	for _, args := range [][]string{
+		{"-C", dir, "add", "--", name},
+		{"-C", dir, "commit", "-m", message, "--", name},
+	} {
+		if _, stderr, err := runCommand("git", args...); err != nil {
+			return fmt.Errorf("error committing spec file: %v\nStderr: %s", err, stderr)
+		}
+	}
+	return nil
 }